@@ -0,0 +1,87 @@
+package roms_test
+
+import (
+	"bytes"
+	"cheepcheep/chiptest"
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+/**
+Golden files:
+	- Every ROM in this directory is assembled and run, the results are compared against files in testdata
+		- <rom>.hex  the assembled bytes, one instruction sized row of 4 bytes per line
+		- <rom>.out  everything the ROM printed with PRINT followed by everything it wrote to the console
+		- <rom>.in   optional, the console input the ROM is run with
+	- Run `go test ./ROMs -update` to rewrite the golden files after an intended change in behavior
+*/
+
+var update = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+func TestROMs(t *testing.T) {
+	roms, _ := filepath.Glob("*.chippy")
+	if len(roms) == 0 {
+		t.Fatal("no ROMs found")
+	}
+
+	for _, rom := range roms {
+		rom := rom
+		name := strings.TrimSuffix(rom, ".chippy")
+		t.Run(name, func(t *testing.T) {
+			source, err := os.ReadFile(rom)
+			if err != nil {
+				t.Fatal(err)
+			}
+			input, err := os.ReadFile(filepath.Join("testdata", name+".in"))
+			if err != nil && !errors.Is(err, fs.ErrNotExist) {
+				t.Fatal(err)
+			}
+
+			result := chiptest.RunWithOptions(t, string(source), chiptest.Options{Input: string(input), Seed: 1})
+			result.AssertNoFault()
+			assertGolden(t, filepath.Join("testdata", name+".hex"), hexDump(result.ROM))
+			assertGolden(t, filepath.Join("testdata", name+".out"), result.Output+result.Console)
+		})
+	}
+}
+
+// hexDump formats the bytes of a ROM a row per instruction so changes show up as readable diffs
+func hexDump(rom []byte) string {
+	var dump strings.Builder
+	for start := 0; start < len(rom); start += 4 {
+		end := start + 4
+		if end > len(rom) {
+			end = len(rom)
+		}
+		fmt.Fprintf(&dump, "%04x: % x\n", start, rom[start:end])
+	}
+	return dump.String()
+}
+
+// assertGolden compares got with the contents of a golden file, or rewrites the file with -update
+func assertGolden(t *testing.T, path string, got string) {
+	t.Helper()
+	if *update {
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(got), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+
+	want, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("missing golden file, run with -update to create it: %s", err)
+	}
+	if !bytes.Equal(want, []byte(got)) {
+		t.Errorf("%s differs from the golden file\ngot:\n%s\nwant:\n%s", path, got, want)
+	}
+}
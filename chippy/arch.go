@@ -1,97 +1,112 @@
 package chippy
 
-// The OPCODES table is broken up as follows:
-/**
-Index 0: The bytecode for the instruction
-Index 1: The number of arguments
-Index 2: The type of the second argument
-Index 3: The type of the third argument
-...
-*/
-const (
-	BYTECODE = iota
-	NUMARGS
-)
+import "cheepcheep/isa"
 
 /*
 	Notes on compiled bytecodes:
-		- Most operations are operations on registers
+		- The opcode numbers, mnemonics, operand layouts, register numbering and the encoding itself live
+		  in the isa package and are shared with the emulator
 		- The addressing mode is stored along with the opcode
-		- Instructions are broken down as follows: [opcode]<-5bits + [addressing mode]<-3bits + ... arguments
+		- Instructions are broken down as follows: [opcode]<-6bits + [addressing mode]<-2bits + ... arguments
 */
 
 // NOTE:
 /*
-	- Each opcode has a set of supported addressing modes for each of its potential arguments, this set of supported
-	- modes is represented as a bit mask for example: 0011001
+	- Each opcode has a set of supported addressing modes for its flexible operand, this set of supported
+	- modes is represented as a bit mask of node types for example: 0011001
 	- to query if an addressing mode is supported we simply apply it mask bitmask & code, the ith bit represents
       if the opcode supports addressing mode i.
-	- Each argument has its own supported set of addressing modes: eg. the first argument of load only supports registers
-	  while the second argument can be whatever we want.
+	- Every other operand is a plain register (see isa.OperandKind) so it only ever accepts a RegisterValue
 
 */
 
-var OPCODES = map[string][]uint16{
-	// halt
-	"HLT": {0x0, 0},
+// jumpTarget is the set of operands a jump or call accepts
+const jumpTarget = Addr | Label | RegisterRelativeValue | PCRelativeValue
 
+// FLEXIBLE_OPERANDS maps every opcode with a flexible operand to the node types that operand accepts,
+// the number of operands and which of them are registers comes from isa.OPCODES
+var FLEXIBLE_OPERANDS = map[isa.Opcode]nodeType{
 	// move value into register, either from a register or a direct value
-	"MOV": {0x1, 2, RegisterValue, Addr | RegisterValue | RegisterRelativeValue},
+	isa.MOV: ImmediateValue | Label | RegisterValue,
 
 	// load value from memory into a register
-	"LDR": {0x2, 2, RegisterValue, ImmediateValue | RegisterRelativeValue},
+	isa.LDR: ImmediateValue | Label | Addr | RegisterRelativeValue | PCRelativeValue,
+
+	// store the value of a register into memory
+	isa.STR: Addr | Label | RegisterValue | RegisterRelativeValue | PCRelativeValue,
 
-	// print contents of register to standard out
-	"PRINT": {0x3, 1, RegisterValue},
+	// load and store a 16 bit big endian word instead of a single byte
+	isa.LDW: ImmediateValue | Label | Addr | RegisterRelativeValue | PCRelativeValue,
+	isa.STW: Addr | Label | RegisterValue | RegisterRelativeValue | PCRelativeValue,
 
 	// add to the value stored in a register
-	"ADD": {0x8, 2, RegisterValue, ImmediateValue | RegisterValue},
-	"SUB": {0x9, 2, RegisterValue, ImmediateValue | RegisterValue},
-	"MUL": {0xA, 2, RegisterValue, ImmediateValue | RegisterValue},
-	"DIV": {0xB, 2, RegisterValue, ImmediateValue | RegisterValue},
-	"XOR": {0xC, 2, RegisterValue, ImmediateValue | RegisterValue},
-	"AND": {0xD, 2, RegisterValue, ImmediateValue | RegisterValue},
-	"OR":  {0xE, 2, RegisterValue, ImmediateValue | RegisterValue},
-	"NOT": {0xF, 2, RegisterValue, ImmediateValue | RegisterValue},
+	isa.ADD: ImmediateValue | RegisterValue,
+	isa.SUB: ImmediateValue | RegisterValue,
+	isa.MUL: ImmediateValue | RegisterValue,
+	isa.DIV: ImmediateValue | RegisterValue,
+	isa.XOR: ImmediateValue | RegisterValue,
+	isa.AND: ImmediateValue | RegisterValue,
+	isa.OR:  ImmediateValue | RegisterValue,
+	isa.NOT: ImmediateValue | RegisterValue,
 
 	// compare the two values, the one stored in r1 and the second operand
-	"CMP": {0x4, 2, RegisterValue, ImmediateValue | RegisterValue},
-
-	// jump instructions based on conditional flags
-	"JMPL":  {0x5, 1, Addr | Label | RegisterRelativeValue | PCRelativeValue},
-	"JMPG":  {0x6, 1, Addr | Label | RegisterRelativeValue | PCRelativeValue},
-	"JMP":   {0x7, 1, Addr | Label | RegisterRelativeValue | PCRelativeValue},
-	"JMPLE": {0x10, 1, Addr | Label | RegisterRelativeValue | PCRelativeValue},
-	"JMPGE": {0x11, 1, Addr | Label | RegisterRelativeValue | PCRelativeValue},
+	isa.CMP: ImmediateValue | RegisterValue,
+
+	// jump instructions based on conditional flags, the aliases JLT, JGT, JLE and JGE (see isa.ALIASES)
+	// share the entries of JMPL, JMPG, JMPLE and JMPGE
+	isa.JMPL:  jumpTarget,
+	isa.JMPG:  jumpTarget,
+	isa.JMP:   jumpTarget,
+	isa.JMPLE: jumpTarget,
+	isa.JMPGE: jumpTarget,
+	isa.JEQ:   jumpTarget,
+	isa.JNE:   jumpTarget,
+	isa.JB:    jumpTarget,
+	isa.JAE:   jumpTarget,
+	isa.JBE:   jumpTarget,
+	isa.JA:    jumpTarget,
+
+	// push a value onto the stack
+	isa.PUSH: ImmediateValue | Label | RegisterValue,
+
+	// call a subroutine, call takes the same operands as a jump
+	isa.CALL: jumpTarget,
+
+	// set up a stack frame with room for n bytes of locals
+	isa.ENTER: ImmediateValue,
+}
+
+// lookupOpcode finds the opcode of an upper case mnemonic or alias
+func lookupOpcode(mnemonic string) (isa.Opcode, bool) {
+	opcode, ok := isa.MNEMONICS[mnemonic]
+	return opcode, ok
 }
 
-// The register table maps register value to their appropriate numeric value on the arch
-var REGISTERS = map[string]uint8{
-	"r1":   1,
-	"r2":   2,
-	"r3":   3,
-	"r4":   4,
-	"r5":   5,
-	"r6":   6,
-	"r7":   7,
-	"r8":   8,
-	"r9":   9,
-	"r10":  10,
-	"r11":  11,
-	"r12":  12,
-	"r14":  13,
-	"sp":   14,
-	"cmp":  15,
-	"zero": 16,
+// operandTypes returns the node types accepted by each operand of an instruction
+func operandTypes(opcode isa.Opcode) []nodeType {
+	kinds := isa.OPCODES[opcode].Operands
+	types := make([]nodeType, len(kinds))
+	for i, kind := range kinds {
+		types[i] = RegisterValue
+		if kind == isa.FlexibleOperand {
+			types[i] = FLEXIBLE_OPERANDS[opcode]
+		}
+	}
+	return types
 }
 
-// ADDRMODES maps nodeTypes to integers representing
-// the addr mode
-var ADDRMODES = map[nodeType]uint8{
-	ImmediateValue:        0,
-	Label:                 0,
-	Addr:                  0,
-	RegisterValue:         1,
-	RegisterRelativeValue: 2,
-	PCRelativeValue:       3,
+// The register table maps register value to their appropriate numeric value on the arch,
+// it is owned by the isa package
+var REGISTERS = isa.REGISTERS
+
+// ADDRMODES maps nodeTypes to the addressing mode they
+// are encoded with, note that a direct address [x] is simply
+// register relative addressing off the zero register
+var ADDRMODES = map[nodeType]isa.AddrMode{
+	ImmediateValue:        isa.Immediate,
+	Label:                 isa.Immediate,
+	Addr:                  isa.RegisterRelative,
+	RegisterValue:         isa.Register,
+	RegisterRelativeValue: isa.RegisterRelative,
+	PCRelativeValue:       isa.PCRelative,
 }
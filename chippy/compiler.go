@@ -2,68 +2,79 @@ package chippy
 
 import (
 	"bufio"
+	"cheepcheep/isa"
+	"cheepcheep/symbols"
 	"fmt"
 	"io"
-	"strconv"
+	"strings"
 )
 
 // Compilation is a rather easy process, we simply take our list of syntax nodes
 // and evaluate each instruction + its operands individually, however before doing this
 // we need to construct a relocation table for deadling with labels, the function
-// returns a buffered reader that computes the bytecode on the fly
-func Compile(nodes []SyntaxNode) *bufio.Reader {
-	// validate and compute a relocation table for labels
-	relocationTable := computeRelocationTable(nodes)
-	validateInstructionOperands(nodes, relocationTable)
+// returns a buffered reader that computes the bytecode on the fly, if the program is invalid
+// the returned error is a Diagnostics value containing every problem found
+func Compile(nodes []SyntaxNode) (*bufio.Reader, error) {
+	// compute a relocation table for labels, evaluate every expression and
+	// then validate the result
+	nodes, relocationTable, diagnostics := computeRelocationTable(nodes)
+	diagnostics = append(diagnostics, resolveExpressions(nodes, relocationTable)...)
+	diagnostics = append(diagnostics, validateInstructionOperands(nodes)...)
+	if diagnostics.HasErrors() {
+		return nil, diagnostics
+	}
 
 	// Finally return a reader for our compiled bytecodes
 	return bufio.NewReader(
 		&CompiledOps{
-			nodes:             nodes,
-			relocationTable:   relocationTable,
-			nodePosition:      0,
-			instructionBuffer: [4]byte{},
-			bufferSize:        0,
+			nodes:        nodes,
+			nodePosition: 0,
+			address:      0,
+			buffer:       nil,
 		},
-	)
+	), nil
 }
 
 // CompiledOps is an implementation of io.Reader
 // implementing io.Reader allows us to write directly to a file
 // without having to create a buffer in memory and then copying that over to a file
 type CompiledOps struct {
-	nodes             []SyntaxNode
-	relocationTable   map[string]uint16
-	nodePosition      int
-	instructionBuffer [4]byte
-	bufferSize        int
+	nodes        []SyntaxNode
+	nodePosition int
+
+	// address is the location counter of the current node and buffer
+	// holds the bytes of the current node that are yet to be read
+	address uint16
+	buffer  []byte
 }
 
 func (c *CompiledOps) Read(p []byte) (int, error) {
-	// first empty the instruction buffer, there should be at most
-	// 4 values in the instruction buffer
 	pn := 0
-	for i := 4 - c.bufferSize; i < 4; i++ {
-		p[pn] = c.instructionBuffer[i]
-		pn++
-	}
-
-	// now translate the current instruction
-	for pn < len(p) && c.nodePosition < len(c.nodes) {
-		if c.nodes[c.nodePosition].NodeType == Label {
-			c.nodePosition++
+	for pn < len(p) {
+		// first empty the buffer
+		if len(c.buffer) > 0 {
+			written := copy(p[pn:], c.buffer)
+			c.buffer = c.buffer[written:]
+			pn += written
 			continue
 		}
 
-		// translate to the buffer and write it out
-		c.bufferSize = 4
-		translateToBuffer(c.nodes[c.nodePosition], c.relocationTable, &c.instructionBuffer)
-		// write the buffer out
-		for i := 0; i < 4 && pn < len(p); i++ {
-			p[pn] = c.instructionBuffer[i]
-			c.bufferSize--
-			pn++
+		if c.nodePosition >= len(c.nodes) {
+			break
+		}
+
+		// labels dont emit anything, otherwise translate the current instruction
+		// or directive into the buffer
+		node := c.nodes[c.nodePosition]
+		switch node.NodeType {
+		case Instruction:
+			var instructionBuffer [isa.InstructionSize]byte
+			translateToBuffer(node, &instructionBuffer)
+			c.buffer = instructionBuffer[:]
+		case Directive:
+			c.buffer = translateDirective(node, c.address)
 		}
+		c.address += uint16(len(c.buffer))
 		c.nodePosition++
 	}
 
@@ -73,150 +84,144 @@ func (c *CompiledOps) Read(p []byte) (int, error) {
 	return pn, nil
 }
 
-// translateToBuffer writes an instruction to a 4 byte buffer
-// write out the opcode
-// we need to identify the addressing mode as well
-// finally we need to pack the operands into the final 3 bytes, the general rules are:
-// 	- register values take 4 bits
-// 	- normal values take up 16 bits
-//	- register relative values take 20 bits
-//  - PC relative values take 16 bits
-//	- addresses take 16 bits
-// eg: add $r1, $r2, 3 would encode to:
-//	- [0001][0010][0000 0000][0000 0011]
+// translateToBuffer writes an instruction to a 4 byte buffer, the
+// actual bit packing is done by the isa package, here we just need to
+// work out the addressing mode and the value of each operand, see isa.Encode
+// for the packing rules, by this point every expression (including labels)
+// has been evaluated
+// eg: add $r1, #3 would encode to:
+//   - [001000 00][0001][0000 0000 0000 0011][0000]
+//
 // eg: ldr $r1, 3+$r3 would encode to
-//	- [0001][0011][0000 0000][0000 0011]
-func translateToBuffer(node SyntaxNode, relocationTable map[string]uint16, output *[4]byte) {
-	translationTable := OPCODES[node.Value]
-
-	// pack in the instruction first
-	var instruction uint32 = (uint32(translationTable[0]) << 26) | (uint32(resolveAddressingMode(node, translationTable)) << 24)
-	var consumedBits uint32 = 8
+//   - [000010 10][0001][0011][0000 0000 0000 0011]
+func translateToBuffer(node SyntaxNode, output *[isa.InstructionSize]byte) {
+	opcode, _ := lookupOpcode(node.Value)
+	instruction := isa.Instruction{Opcode: opcode}
 
-	// now we pack the individual operands into the instruction, this is mostly just a bunch of
+	// the operands are a series of plain registers optionally followed by a single
+	// operand that supports several addressing modes, this is mostly just a bunch of
 	// case work
-	for _, token := range node.Children {
-		if consumedBits == 32 {
-			panic("Compilation Failure - Internal error: cannot pack instructions into 4 bytes.")
+	operandKinds := isa.OPCODES[instruction.Opcode].Operands
+	for i, token := range node.Children {
+		if operandKinds[i] == isa.RegisterOperand {
+			instruction.Reg = REGISTERS[token.Value]
+			continue
 		}
 
-		if token.NodeType == RegisterValue {
-			consumeRegister(token.Value, &instruction, &consumedBits)
-
-		} else if token.NodeType == ImmediateValue || token.NodeType == Addr || token.NodeType == Instruction || token.NodeType == PCRelativeValue {
-			consumeTwoBytes(token.Value, &instruction, &consumedBits)
-
-		} else if token.NodeType == RegisterRelativeValue {
-			consumeRegister(token.Value, &instruction, &consumedBits)
-			consumeTwoBytes(token.Argument, &instruction, &consumedBits)
-
-		} else if token.NodeType == Label {
-			// translate the label and write it out, i hate that im doing this
-			var translation uint16 = relocationTable[token.Value]
-			consumeTwoBytes(strconv.Itoa(int(translation)), &instruction, &consumedBits)
+		instruction.Mode = ADDRMODES[token.NodeType]
+		switch token.NodeType {
+		case ImmediateValue, Addr, PCRelativeValue, Label:
+			instruction.Value = parseTwoBytes(token.Value)
+		case RegisterValue:
+			instruction.Base = REGISTERS[token.Value]
+		case RegisterRelativeValue:
+			instruction.Base = REGISTERS[token.Value]
+			instruction.Value = parseTwoBytes(token.Argument)
 		}
 	}
 
-	// finally write out the instructio to the buffer
-	for i := 3; i >= 0; i-- {
-		(*output)[i] = byte((instruction >> (8 * uint32(i))) & 255)
-	}
-}
-
-// consume function adds a register value to the instruction so far
-func consumeRegister(value string, instruction *uint32, consumedBits *uint32) {
-	regValue := REGISTERS[value]
-	*instruction |= (uint32(regValue) << (32 - *consumedBits - 4))
-	*consumedBits += 4
-}
-
-// consume two bytes consumes a two byte value and adds it to the
-// instruction
-func consumeTwoBytes(value string, instruction *uint32, consumedBits *uint32) {
-	val, err := strconv.ParseUint(value, 10, 16)
+	encoded, err := isa.Encode(instruction)
 	if err != nil {
-		panic(err)
-	}
-	*instruction |= (uint32(val)) << (32 - *consumedBits - 16)
-	*consumedBits += 16
-}
-
-// resolveAddressingMode resolves the addressing mode for an instruction
-// given its opcode table entry
-func resolveAddressingMode(node SyntaxNode, opEntry []uint16) uint8 {
-	// for each operation exactly 1 parameter supports different ways of being called
-	// we just need to identify that parameter for this opEntry, the complication
-	// is that IMMEDIATE values can be of several differnt types
-	supportsManyArgs := 2
-	for supportsManyArgs < len(opEntry) && (opEntry[supportsManyArgs] == RegisterValue ||
-		opEntry[supportsManyArgs] == RegisterRelativeValue ||
-		opEntry[supportsManyArgs] == PCRelativeValue ||
-		isImmediate(opEntry[supportsManyArgs])) {
-		supportsManyArgs++
+		panic(fmt.Sprintf("Compilation Failure - Internal error: %s.", err))
 	}
-
-	// we have to return the appropriate bitcode for this addrmode
-	argIndex := max(0, supportsManyArgs-2)
-	// there is an edge case here with an operation has a single argument
-	if len(node.Children) == 1 {
-		argIndex = 0
-	}
-
-	return ADDRMODES[node.Children[argIndex].NodeType]
+	*output = encoded
 }
 
-// is immediate addr mode tells us if a integer of accepted types is all
-// immediate
-func isImmediate(nodeType uint16) bool {
-	return nodeType&RegisterValue == 0 &&
-		nodeType&RegisterRelativeValue == 0 &&
-		nodeType&PCRelativeValue == 0
+// parseTwoBytes parses a two byte value out of an operand, operands are validated
+// before translation so a failure here is an internal error
+func parseTwoBytes(value string) uint16 {
+	return uint16(mustParseDataValue(value, 16))
 }
 
 // validateInstructionOperands iterates over every instruction and validates
-// if its operands are valid
-func validateInstructionOperands(nodes []SyntaxNode, relocationTable map[string]uint16) {
+// if its operands are valid, this includes checking every value fits in its operand
+func validateInstructionOperands(nodes []SyntaxNode) Diagnostics {
+	diagnostics := Diagnostics{}
 	for _, node := range nodes {
 		if node.NodeType == Label {
 			continue
+		} else if node.NodeType == Directive {
+			// the directive's argument types are validated as they're parsed
+			// we just need to check the evaluated values fit
+			spec := DIRECTIVES[node.Value]
+			for i, arg := range node.Children {
+				if arg.NodeType != ImmediateValue || len(spec.bits) == 0 {
+					continue
+				}
+				if _, err := parseDataValue(arg.Value, spec.bits[min(i, len(spec.bits)-1)], spec.signed); err != nil {
+					diagnostics = append(diagnostics, rangeError(arg, err))
+				}
+			}
+			continue
 		}
 
 		// iterate over the children for an instruction node
-		opData := OPCODES[node.Value]
+		opcode, _ := lookupOpcode(node.Value)
+		accepted := operandTypes(opcode)
 
 		for i, arg := range node.Children {
 			argType := arg.NodeType
-			if argType == Label {
-				if _, ok := relocationTable[arg.Value]; !ok {
-					panic(fmt.Sprintf(`Compilation Error - Undefined label "%s" on line: %d.`,
-						arg.Value, node.line))
-				}
+			if accepted[i]&argType == 0 {
+				diagnostics = append(diagnostics, errorAtNode(arg, `Invalid argument type of "%s" for instruction "%s"`,
+					arg.source, node.Value))
+				continue
 			}
 
-			if opData[2+i]&argType == 0 {
-				panic(fmt.Sprintf(`Compilation Error - Invalid argument type of "%s" for instruction "%s" on line: %d.`,
-					arg.Value, node.Value, node.line))
+			// every numeric value we encode must fit into two bytes
+			for _, expression := range operandExpressions(&arg) {
+				if _, err := parseDataValue(*expression, 16, true); err != nil {
+					diagnostics = append(diagnostics, rangeError(arg, err))
+				}
 			}
 		}
 	}
+	return diagnostics
 }
 
-// note on addresses: addresses are all 16 bit unsigned integers
-func computeRelocationTable(nodes []SyntaxNode) map[string]uint16 {
-	var currentAddr uint16 = 0
-	var relocationTable = make(map[string]uint16)
+// rangeError reports a value that doesn't fit in its operand, if the value came from an
+// expression the expression is included in the message
+func rangeError(arg SyntaxNode, err error) Diagnostic {
+	for _, expression := range operandExpressions(&arg) {
+		if !strings.Contains(arg.source, *expression) {
+			return errorAtNode(arg, "%s (evaluated from %s)", err, arg.source)
+		}
+	}
+	return errorAtNode(arg, "%s", err)
+}
 
+// DebugInfo computes the symbol table for a program, it maps every label to its address
+// and the address of every instruction back to the source line it came from
+func DebugInfo(nodes []SyntaxNode) (*symbols.Table, error) {
+	nodes, relocationTable, diagnostics := computeRelocationTable(nodes)
+	table := symbols.NewTable()
+	table.Labels = relocationTable
+
+	var currentAddr uint16 = 0
 	for _, node := range nodes {
-		if node.NodeType == Label {
-			// resolve this label by first checking if its been relocated yet
-			if _, ok := relocationTable[node.Value]; ok {
-				panic(fmt.Sprintf(`Compilation Error - Duplicate definition of label: "%s"`, node.Value))
-			} else {
-				relocationTable[node.Value] = currentAddr + 4
-			}
+		// nodes that take up no space (labels, constants) don't own an address
+		size := max(nodeSize(node, currentAddr), 0)
+		if size > 0 {
+			table.AddLine(symbols.LineEntry{
+				Address: currentAddr,
+				File:    node.file,
+				Line:    node.line + 1,
+				Column:  node.col + 1,
+			})
 		}
+		currentAddr += uint16(size)
+	}
+	return table, diagnostics.asError()
+}
 
-		currentAddr += 4
+// nodeSize is the number of bytes a node takes up in the compiled output when placed
+// at the given address, it's negative if the node would move the location counter backwards
+func nodeSize(node SyntaxNode, address uint16) int {
+	switch node.NodeType {
+	case Label:
+		return 0
+	case Directive:
+		return directiveSize(node, address)
+	default:
+		return isa.InstructionSize
 	}
-	return relocationTable
 }
@@ -0,0 +1,200 @@
+package chippy
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+)
+
+// Severity indicates how serious a diagnostic is, only errors stop
+// the assembler from producing output
+type Severity int
+
+const (
+	SeverityError Severity = iota
+	SeverityWarning
+	SeverityNote
+)
+
+func (s Severity) String() string {
+	switch s {
+	case SeverityWarning:
+		return "warning"
+	case SeverityNote:
+		return "note"
+	}
+	return "error"
+}
+
+// Diagnostic is a single problem found while assembling a file, lines and
+// columns are 1 indexed
+type Diagnostic struct {
+	File     string
+	Line     int
+	Column   int
+	Severity Severity
+	Message  string
+
+	// Token is the offending piece of source, it may be empty if the
+	// problem isn't tied to a particular token (eg. an unexpected EOF)
+	Token string
+
+	// Notes carry extra locations related to the diagnostic, such as the
+	// call sites of the macros the offending token was expanded from
+	Notes []Diagnostic
+}
+
+func (d Diagnostic) Error() string {
+	message := fmt.Sprintf("%s:%d:%d: %s: %s", d.File, d.Line, d.Column, d.Severity, d.Message)
+	for _, note := range d.Notes {
+		message += "\n" + note.Error()
+	}
+	return message
+}
+
+// Excerpt renders the diagnostic along with the offending source line and a caret
+// underneath the offending token, source is the full contents of the diagnostic's file
+func (d Diagnostic) Excerpt(source []byte) string {
+	lines := strings.Split(strings.ReplaceAll(string(source), "\r\n", "\n"), "\n")
+	if d.Line < 1 || d.Line > len(lines) {
+		return fmt.Sprintf("%s:%d:%d: %s: %s", d.File, d.Line, d.Column, d.Severity, d.Message)
+	}
+
+	sourceLine := lines[d.Line-1]
+	column := min(max(d.Column-1, 0), len(sourceLine))
+	underline := max(len(d.Token), 1)
+
+	// tabs are kept in the padding so the caret lines up with the source line
+	padding := strings.Map(func(r rune) rune {
+		if r == '\t' {
+			return r
+		}
+		return ' '
+	}, sourceLine[:column])
+
+	return fmt.Sprintf("%s:%d:%d: %s: %s\n    %s\n    %s%s", d.File, d.Line, d.Column, d.Severity, d.Message,
+		sourceLine, padding, strings.Repeat("^", underline))
+}
+
+// Diagnostics is a list of diagnostics collected over an entire run of the assembler,
+// it is returned as the error value of Parse and Compile
+type Diagnostics []Diagnostic
+
+func (d Diagnostics) Error() string {
+	errors := []string{}
+	for _, diagnostic := range d.Sorted() {
+		errors = append(errors, diagnostic.Error())
+	}
+	return strings.Join(errors, "\n")
+}
+
+// Report writes every diagnostic to w along with an excerpt of the offending source, notes (such as the
+// macro call sites a diagnostic was expanded from) are written after the diagnostic they belong to
+func (d Diagnostics) Report(w io.Writer) {
+	sources := map[string][]byte{}
+	for _, diagnostic := range d.Sorted() {
+		for _, entry := range append(Diagnostics{diagnostic}, diagnostic.Notes...) {
+			if _, ok := sources[entry.File]; !ok {
+				sources[entry.File], _ = os.ReadFile(entry.File)
+			}
+			fmt.Fprintln(w, entry.Excerpt(sources[entry.File]))
+		}
+	}
+}
+
+// HasErrors determines if any of the diagnostics are errors
+func (d Diagnostics) HasErrors() bool {
+	for _, diagnostic := range d {
+		if diagnostic.Severity == SeverityError {
+			return true
+		}
+	}
+	return false
+}
+
+// Sorted returns a copy of the diagnostics ordered by their position in the source
+func (d Diagnostics) Sorted() Diagnostics {
+	sorted := append(Diagnostics{}, d...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		if sorted[i].File != sorted[j].File {
+			return sorted[i].File < sorted[j].File
+		}
+		if sorted[i].Line != sorted[j].Line {
+			return sorted[i].Line < sorted[j].Line
+		}
+		return sorted[i].Column < sorted[j].Column
+	})
+	return sorted
+}
+
+// asError converts the collected diagnostics into an error value, it is only
+// non nil if there was at least one error
+func (d Diagnostics) asError() error {
+	if !d.HasErrors() {
+		return nil
+	}
+	return d
+}
+
+// errorAtToken constructs an error diagnostic pointing at a token
+func errorAtToken(token Token, format string, args ...any) Diagnostic {
+	return Diagnostic{
+		File:     token.file,
+		Line:     token.line + 1,
+		Column:   token.column + 1,
+		Severity: SeverityError,
+		Message:  fmt.Sprintf(format, args...),
+		Token:    string(token.Value),
+		Notes:    expansionNotes(token.expandedFrom),
+	}
+}
+
+// errorAtNode constructs an error diagnostic pointing at a syntax node
+func errorAtNode(node SyntaxNode, format string, args ...any) Diagnostic {
+	return Diagnostic{
+		File:     node.file,
+		Line:     node.line + 1,
+		Column:   node.col + 1,
+		Severity: SeverityError,
+		Message:  fmt.Sprintf(format, args...),
+		Token:    node.source,
+		Notes:    expansionNotes(node.expandedFrom),
+	}
+}
+
+// expansionNotes walks back through the chain of macro call sites a token was expanded from
+// and produces a note for each, innermost first
+func expansionNotes(site *Token) []Diagnostic {
+	notes := []Diagnostic{}
+	for ; site != nil; site = site.expandedFrom {
+		notes = append(notes, noteAtToken(*site, `in expansion of macro "%s"`, site.Value))
+	}
+	return notes
+}
+
+// noteAtNode constructs a note pointing at a syntax node
+func noteAtNode(node SyntaxNode, format string, args ...any) Diagnostic {
+	return Diagnostic{
+		File:     node.file,
+		Line:     node.line + 1,
+		Column:   node.col + 1,
+		Severity: SeverityNote,
+		Message:  fmt.Sprintf(format, args...),
+		Token:    node.source,
+	}
+}
+
+// noteAtToken constructs a note pointing at a token, notes are attached to
+// other diagnostics rather than reported on their own
+func noteAtToken(token Token, format string, args ...any) Diagnostic {
+	return Diagnostic{
+		File:     token.file,
+		Line:     token.line + 1,
+		Column:   token.column + 1,
+		Severity: SeverityNote,
+		Message:  fmt.Sprintf(format, args...),
+		Token:    string(token.Value),
+	}
+}
@@ -0,0 +1,230 @@
+package chippy
+
+import (
+	"encoding/binary"
+	"fmt"
+	"regexp"
+	"strconv"
+)
+
+/*
+	Directives place raw data into the assembled output rather than instructions, unlike instructions they take
+	a variable number of arguments, all of which must be on the same line as the directive:
+		.byte 1, 2, -1       8 bit values
+		.word 300, .label    16 bit values or label addresses, stored big endian like instructions
+		.ascii "hi\n"        the bytes of one or more strings, strings use Go's escape sequences
+		.asciiz "hi"         the same as .ascii but each string is followed by a null terminator
+		.space 10, 255       reserve n bytes, optionally filled with the given value (defaults to 0)
+		.org 256             move the location counter forward to the given address, padding with zeros
+	Numeric arguments are expressions (see expressions.go) and may optionally be prefixed with a # like immediate values.
+
+	There are also two directives that define named constants rather than emitting data:
+		.equ SIZE, 16        define a constant, it can't be redefined
+		.set COUNT, 0        define a constant that may be redefined later on, uses see the most recent definition
+	Since .space and .org decide where labels end up, their arguments (and the values of constants) can only refer to
+	labels and constants that have already been defined.
+
+	When assembling to a relocatable object (see linker.go) labels are shared between files with:
+		.global .main        export labels defined in this file to other objects
+		.extern .print       import labels defined in another object
+	Outside of an object these have no effect.
+*/
+
+type directiveSpec struct {
+	minArgs int
+	// maxArgs is unlimitedArgs if the directive takes any number of arguments
+	maxArgs  int
+	argTypes nodeType
+
+	// bits is the width of each numeric argument, if there are more arguments than
+	// entries the final entry is used, signed determines if negative values are allowed
+	bits   []int
+	signed bool
+
+	// named is set if the first argument is the name of a constant
+	named bool
+}
+
+const unlimitedArgs = -1
+
+var DIRECTIVES = map[string]directiveSpec{
+	".byte":   {1, unlimitedArgs, ImmediateValue, []int{8}, true, false},
+	".word":   {1, unlimitedArgs, ImmediateValue, []int{16}, true, false},
+	".ascii":  {1, unlimitedArgs, StringValue, nil, false, false},
+	".asciiz": {1, unlimitedArgs, StringValue, nil, false, false},
+	".space":  {1, 2, ImmediateValue, []int{16, 8}, false, false},
+	".org":    {1, 1, ImmediateValue, []int{16}, false, false},
+	".equ":    {2, 2, Identifier | ImmediateValue, nil, false, true},
+	".set":    {2, 2, Identifier | ImmediateValue, nil, false, true},
+	".global": {1, unlimitedArgs, Label, nil, false, false},
+	".extern": {1, unlimitedArgs, Label, nil, false, false},
+}
+
+// PREPROCESSOR_DIRECTIVES are handled before the token stream is parsed (see include.go and macros.go)
+// so the parser never sees them
+var PREPROCESSOR_DIRECTIVES = map[string]bool{
+	".include": true,
+	".macro":   true,
+	".endm":    true,
+}
+
+var dataValueRegex = regexp.MustCompile(`^#?(?P<Value>.+)$`)
+var identifierRegex = regexp.MustCompile(`^(?P<Value>[A-Za-z_]\w*)$`)
+
+// consumeDirective converts a directive and its arguments (the rest of the directive's line)
+// into a syntax node, checking them against the directive's spec
+func consumeDirective(directive Token, arguments []Token) (SyntaxNode, Diagnostics) {
+	spec := DIRECTIVES[string(directive.Value)]
+	node := SyntaxNode{
+		NodeType: Directive,
+		Value:    string(directive.Value),
+		file:     directive.file, source: string(directive.Value),
+		line: directive.line, col: directive.column,
+		expandedFrom: directive.expandedFrom,
+	}
+	diagnostics := Diagnostics{}
+
+	consumed := len(arguments)
+	for _, arg := range arguments {
+		child, diagnostic := createDirectiveValueNode(arg, spec, len(node.Children))
+		if diagnostic != nil {
+			diagnostics = append(diagnostics, *diagnostic)
+			continue
+		}
+		node.Children = append(node.Children, child)
+	}
+
+	if consumed < spec.minArgs {
+		diagnostics = append(diagnostics, errorAtToken(directive, `"%s" expects at least %d argument(s) but got %d`,
+			directive.Value, spec.minArgs, consumed))
+	} else if spec.maxArgs != unlimitedArgs && consumed > spec.maxArgs {
+		diagnostics = append(diagnostics, errorAtToken(directive, `"%s" expects at most %d argument(s) but got %d`,
+			directive.Value, spec.maxArgs, consumed))
+	}
+	return node, diagnostics
+}
+
+// createDirectiveValueNode converts the argument of a directive to a syntax node and validates it
+// against the directive's spec, index is the position of the argument
+func createDirectiveValueNode(token Token, spec directiveSpec, index int) (SyntaxNode, *Diagnostic) {
+	node := SyntaxNode{
+		file:   token.file,
+		source: string(token.Value),
+		line:   token.line,
+		col:    token.column,
+		endCol: token.endColumn,
+
+		expandedFrom: token.expandedFrom,
+	}
+
+	if spec.named && index == 0 {
+		matches, ok := matchNamedGroups(identifierRegex, token.Value)
+		if !ok {
+			diagnostic := errorAtToken(token, `Invalid constant name "%s"`, token.Value)
+			return node, &diagnostic
+		}
+		node.NodeType, node.Value = Identifier, string(matches["Value"])
+	} else if len(token.Value) != 0 && token.Value[0] == '"' {
+		value, err := strconv.Unquote(string(token.Value))
+		if err != nil {
+			diagnostic := errorAtToken(token, `Invalid string literal %s`, token.Value)
+			return node, &diagnostic
+		}
+		node.NodeType, node.Value = StringValue, value
+	} else if matches, ok := matchNamedGroups(labelRegex, token.Value); ok && spec.argTypes&Label != 0 {
+		node.NodeType, node.Value = Label, string(matches["Value"])
+	} else if matches, ok := matchNamedGroups(dataValueRegex, token.Value); ok {
+		node.NodeType, node.Value = ImmediateValue, string(matches["Value"])
+		if err := validateExpression(node.Value); err != nil {
+			diagnostic := errorAtToken(token, `%s`, err)
+			return node, &diagnostic
+		}
+	}
+
+	if spec.argTypes&node.NodeType == 0 {
+		diagnostic := errorAtToken(token, `Invalid argument type of "%s" for directive`, token.Value)
+		return node, &diagnostic
+	}
+	return node, nil
+}
+
+// parseDataValue parses an evaluated numeric value and checks that it fits in the given number of bits,
+// negative values are stored in two's complement
+func parseDataValue(value string, bits int, signed bool) (uint64, error) {
+	parsed, err := strconv.ParseInt(value, 10, 64)
+	minimum := int64(0)
+	if signed {
+		minimum = -(1 << (bits - 1))
+	}
+	if err != nil || parsed < minimum || parsed > (1<<bits)-1 {
+		return 0, fmt.Errorf(`Value "%s" does not fit in %d bits`, value, bits)
+	}
+	return uint64(parsed) & (1<<bits - 1), nil
+}
+
+// mustParseDataValue parses a directive argument that was already evaluated and validated
+func mustParseDataValue(value string, bits int) uint64 {
+	parsed, err := parseDataValue(value, bits, true)
+	if err != nil {
+		panic(fmt.Sprintf("Compilation Failure - Internal error: %s.", err))
+	}
+	return parsed
+}
+
+// directiveSize computes the number of bytes a directive places into the output, address
+// is the location counter at the directive, only .org depends on it
+func directiveSize(node SyntaxNode, address uint16) int {
+	switch node.Value {
+	case ".byte":
+		return len(node.Children)
+	case ".word":
+		return 2 * len(node.Children)
+	case ".ascii", ".asciiz":
+		size := 0
+		for _, child := range node.Children {
+			size += len(child.Value)
+			if node.Value == ".asciiz" {
+				size++
+			}
+		}
+		return size
+	case ".space":
+		return int(mustParseDataValue(node.Children[0].Value, 16))
+	case ".org":
+		return int(mustParseDataValue(node.Children[0].Value, 16)) - int(address)
+	}
+	return 0
+}
+
+// translateDirective computes the bytes a directive places into the output
+func translateDirective(node SyntaxNode, address uint16) []byte {
+	output := []byte{}
+	switch node.Value {
+	case ".byte":
+		for _, child := range node.Children {
+			output = append(output, byte(mustParseDataValue(child.Value, 8)))
+		}
+	case ".word":
+		word := make([]byte, 2)
+		for _, child := range node.Children {
+			binary.BigEndian.PutUint16(word, uint16(mustParseDataValue(child.Value, 16)))
+			output = append(output, word...)
+		}
+	case ".ascii", ".asciiz":
+		for _, child := range node.Children {
+			output = append(output, child.Value...)
+			if node.Value == ".asciiz" {
+				output = append(output, 0)
+			}
+		}
+	case ".space", ".org":
+		var fill byte = 0
+		if len(node.Children) > 1 {
+			fill = byte(mustParseDataValue(node.Children[1].Value, 8))
+		}
+		for i := 0; i < directiveSize(node, address); i++ {
+			output = append(output, fill)
+		}
+	}
+	return output
+}
@@ -0,0 +1,293 @@
+package chippy
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+/*
+	Operands and directive arguments can be integer expressions which are evaluated at assemble time, the
+	grammar follows C's precedence rules:
+		or       := xor ("|" xor)*
+		xor      := and ("^" and)*
+		and      := shift ("&" shift)*
+		shift    := additive (("<<" | ">>") additive)*
+		additive := term (("+" | "-") term)*
+		term     := unary (("*" | "/" | "%") unary)*
+		unary    := ("-" | "+" | "~") unary | primary
+		primary  := number | char | label | constant | "(" or ")"
+	Numbers are decimal or prefixed with 0x, 0b or 0o, chars are single quoted and support Go's escape sequences,
+	labels are written as .name and constants (defined with .equ or .set) are plain identifiers.
+*/
+
+// symbolLookup resolves a label (.name) or constant (name) within an expression
+type symbolLookup func(name string) (int64, bool)
+
+// expressionParser is a small recursive descent parser that evaluates as it parses
+type expressionParser struct {
+	text     string
+	position int
+	lookup   symbolLookup
+}
+
+// evaluateExpression parses and evaluates an integer expression, symbols are resolved with lookup
+func evaluateExpression(text string, lookup symbolLookup) (int64, error) {
+	parser := &expressionParser{text: text, lookup: lookup}
+	value, err := parser.parseBinary(0)
+	if err != nil {
+		return 0, err
+	}
+
+	parser.skipSpaces()
+	if parser.position != len(parser.text) {
+		return 0, fmt.Errorf(`Unexpected "%s" in expression "%s"`, parser.text[parser.position:], text)
+	}
+	return value, nil
+}
+
+// validateExpression checks that an expression is syntactically valid without resolving any symbols
+func validateExpression(text string) error {
+	_, err := evaluateExpression(text, func(string) (int64, bool) { return 1, true })
+	return err
+}
+
+// isSingleValue determines if an expression is a lone number, char, label or constant (optionally
+// negated) rather than a calculation or a parenthesised expression
+func isSingleValue(text string) bool {
+	parser := &expressionParser{text: text, lookup: func(string) (int64, bool) { return 1, true }}
+	parser.matchOperator([]string{"-", "+"})
+	if parser.skipSpaces(); parser.position == len(text) || text[parser.position] == '(' {
+		return false
+	}
+	if _, err := parser.parsePrimary(); err != nil {
+		return false
+	}
+	parser.skipSpaces()
+	return parser.position == len(text)
+}
+
+// binary operators grouped by precedence, lowest first
+var binaryOperators = [][]string{
+	{"|"},
+	{"^"},
+	{"&"},
+	{"<<", ">>"},
+	{"+", "-"},
+	{"*", "/", "%"},
+}
+
+func (p *expressionParser) parseBinary(level int) (int64, error) {
+	if level == len(binaryOperators) {
+		return p.parseUnary()
+	}
+
+	left, err := p.parseBinary(level + 1)
+	if err != nil {
+		return 0, err
+	}
+
+	for {
+		operator := p.matchOperator(binaryOperators[level])
+		if operator == "" {
+			return left, nil
+		}
+
+		right, err := p.parseBinary(level + 1)
+		if err != nil {
+			return 0, err
+		}
+		if left, err = applyOperator(operator, left, right); err != nil {
+			return 0, err
+		}
+	}
+}
+
+func applyOperator(operator string, left, right int64) (int64, error) {
+	switch operator {
+	case "|":
+		return left | right, nil
+	case "^":
+		return left ^ right, nil
+	case "&":
+		return left & right, nil
+	case "<<", ">>":
+		if right < 0 || right > 63 {
+			return 0, fmt.Errorf(`Invalid shift amount %d`, right)
+		}
+		if operator == "<<" {
+			return left << right, nil
+		}
+		return left >> right, nil
+	case "+":
+		return left + right, nil
+	case "-":
+		return left - right, nil
+	case "*":
+		return left * right, nil
+	default:
+		if right == 0 {
+			return 0, fmt.Errorf(`Division by zero in expression`)
+		}
+		if operator == "/" {
+			return left / right, nil
+		}
+		return left % right, nil
+	}
+}
+
+func (p *expressionParser) parseUnary() (int64, error) {
+	switch p.matchOperator([]string{"-", "+", "~"}) {
+	case "-":
+		value, err := p.parseUnary()
+		return -value, err
+	case "+":
+		return p.parseUnary()
+	case "~":
+		value, err := p.parseUnary()
+		return ^value, err
+	}
+	return p.parsePrimary()
+}
+
+func (p *expressionParser) parsePrimary() (int64, error) {
+	p.skipSpaces()
+	if p.position == len(p.text) {
+		return 0, fmt.Errorf(`Unexpected end of expression "%s"`, p.text)
+	}
+
+	c := p.text[p.position]
+	switch {
+	case c == '(':
+		p.position++
+		value, err := p.parseBinary(0)
+		if err != nil {
+			return 0, err
+		}
+		if p.skipSpaces(); p.position == len(p.text) || p.text[p.position] != ')' {
+			return 0, fmt.Errorf(`Missing ")" in expression "%s"`, p.text)
+		}
+		p.position++
+		return value, nil
+
+	case c == '\'':
+		return p.parseChar()
+
+	case isDigit(c):
+		word := p.consumeWord()
+		base := 10
+		if len(word) > 2 && word[0] == '0' && strings.ContainsRune("xXbBoO", rune(word[1])) {
+			base = 0
+		}
+		value, err := strconv.ParseInt(word, base, 64)
+		if err != nil {
+			return 0, fmt.Errorf(`Invalid number "%s"`, word)
+		}
+		return value, nil
+
+	case c == '.' || isIdentifierChar(c):
+		name := p.consumeWord()
+		value, ok := p.lookup(name)
+		if !ok && name[0] == '.' {
+			return 0, fmt.Errorf(`Undefined label "%s"`, name)
+		} else if !ok {
+			return 0, fmt.Errorf(`Undefined constant "%s"`, name)
+		}
+		return value, nil
+	}
+	return 0, fmt.Errorf(`Unexpected "%c" in expression "%s"`, c, p.text)
+}
+
+// parseChar parses a single quoted character literal
+func (p *expressionParser) parseChar() (int64, error) {
+	end := p.position + 1
+	for end < len(p.text) && (p.text[end] != '\'' || p.text[end-1] == '\\') {
+		end++
+	}
+	if end == len(p.text) {
+		return 0, fmt.Errorf(`Unterminated character literal in expression "%s"`, p.text)
+	}
+
+	literal := p.text[p.position+1 : end]
+	value, _, tail, err := strconv.UnquoteChar(literal, '\'')
+	if err != nil || tail != "" {
+		return 0, fmt.Errorf(`Invalid character literal '%s'`, literal)
+	}
+	p.position = end + 1
+	return int64(value), nil
+}
+
+// matchOperator consumes the longest operator from the list at the current position
+func (p *expressionParser) matchOperator(operators []string) string {
+	p.skipSpaces()
+	matched := ""
+	for _, operator := range operators {
+		if strings.HasPrefix(p.text[p.position:], operator) && len(operator) > len(matched) {
+			matched = operator
+		}
+	}
+	p.position += len(matched)
+	return matched
+}
+
+// consumeWord consumes a number, identifier or label, including the suffix of a generated name
+func (p *expressionParser) consumeWord() string {
+	start := p.position
+	p.position++
+	for p.position < len(p.text) && (isIdentifierChar(p.text[p.position]) || p.text[p.position] == generatedSeparator) {
+		p.position++
+	}
+	return p.text[start:p.position]
+}
+
+func (p *expressionParser) skipSpaces() {
+	for p.position < len(p.text) && (p.text[p.position] == ' ' || p.text[p.position] == '\t') {
+		p.position++
+	}
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func isIdentifierChar(c byte) bool {
+	return isDigit(c) || c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+// renameSymbols rewrites every label and constant referenced in an expression, rename is called with each
+// symbol and returns its replacement, numbers and character literals are left untouched
+func renameSymbols(text string, rename func(name string) string) string {
+	renamed := strings.Builder{}
+	p := &expressionParser{text: text}
+	for p.position < len(p.text) {
+		start := p.position
+		c := p.text[p.position]
+		switch {
+		case c == '\'':
+			if _, err := p.parseChar(); err != nil {
+				p.position = len(p.text)
+			}
+			renamed.WriteString(p.text[start:p.position])
+		case isDigit(c):
+			renamed.WriteString(p.consumeWord())
+		case c == '.' || isIdentifierChar(c):
+			renamed.WriteString(rename(p.consumeWord()))
+		default:
+			renamed.WriteByte(c)
+			p.position++
+		}
+	}
+	return renamed.String()
+}
+
+// operandExpressions returns pointers to every field of a node holding an expression
+// so that they can be validated or replaced by their evaluated value
+func operandExpressions(node *SyntaxNode) []*string {
+	switch node.NodeType {
+	case ImmediateValue, Addr, PCRelativeValue, Label:
+		return []*string{&node.Value}
+	case RegisterRelativeValue:
+		return []*string{&node.Argument}
+	}
+	return nil
+}
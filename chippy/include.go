@@ -0,0 +1,87 @@
+package chippy
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// maxIncludeDepth is the deepest a chain of nested includes may go
+const maxIncludeDepth = 32
+
+// tokeniseFile tokenises a single source file and cleans the resulting tokens, every token
+// records the file it came from so diagnostics can point back at it
+func tokeniseFile(fileName string, stream bufio.Reader) ([]Token, Diagnostics) {
+	tokens, diagnostics := tokeniseFileStream(stream)
+	for i := range tokens {
+		tokens[i].file = fileName
+	}
+	for i := range diagnostics {
+		diagnostics[i].File = fileName
+	}
+	return cleanTokens(tokens), diagnostics
+}
+
+// expandIncludes replaces every `.include "file"` with the tokens of that file, paths are relative to
+// the directory of the including file, stack is the chain of files currently being included and is
+// used to catch files that include themselves
+func expandIncludes(tokens []Token, stack []string) ([]Token, Diagnostics) {
+	expanded := []Token{}
+	diagnostics := Diagnostics{}
+
+	for i := 0; i < len(tokens); i++ {
+		token := tokens[i]
+		if token.TokenType != DIRECTIVE || string(token.Value) != ".include" {
+			expanded = append(expanded, token)
+			continue
+		}
+
+		args := restOfLine(token, tokens[i+1:])
+		i += len(args)
+		if len(args) != 1 {
+			diagnostics = append(diagnostics, errorAtToken(token, `".include" expects a single file name but got %d argument(s)`, len(args)))
+			continue
+		}
+
+		name, err := strconv.Unquote(string(args[0].Value))
+		if err != nil {
+			diagnostics = append(diagnostics, errorAtToken(args[0], `Invalid file name %s, file names must be quoted`, args[0].Value))
+			continue
+		}
+		path := filepath.Join(filepath.Dir(token.file), name)
+
+		if len(stack) >= maxIncludeDepth {
+			diagnostics = append(diagnostics, errorAtToken(args[0], `Includes are nested more than %d levels deep`, maxIncludeDepth))
+			continue
+		} else if isIncluding(stack, path) {
+			diagnostics = append(diagnostics, errorAtToken(args[0], `"%s" includes itself`, path))
+			continue
+		}
+
+		f, err := os.Open(path)
+		if err != nil {
+			diagnostics = append(diagnostics, errorAtToken(args[0], "Could not include file: %s", err))
+			continue
+		}
+		tokens, lexDiagnostics := tokeniseFile(path, *bufio.NewReader(f))
+		included, includeDiagnostics := expandIncludes(tokens, append(stack, path))
+		f.Close()
+
+		expanded = append(expanded, included...)
+		diagnostics = append(diagnostics, lexDiagnostics...)
+		diagnostics = append(diagnostics, includeDiagnostics...)
+	}
+
+	return expanded, diagnostics
+}
+
+// isIncluding determines if a file is already part of the chain of includes
+func isIncluding(stack []string, path string) bool {
+	for _, file := range stack {
+		if filepath.Clean(file) == filepath.Clean(path) {
+			return true
+		}
+	}
+	return false
+}
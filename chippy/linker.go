@@ -0,0 +1,168 @@
+package chippy
+
+import (
+	"strconv"
+)
+
+/*
+	Programs can be split over several files which are assembled separately into relocatable objects and then
+	linked together into a single ROM. An object is simply the parsed program of a file (after includes and macros
+	have been expanded) along with the labels it exports (.global) and imports (.extern), nothing is laid out until
+	link time. Linking concatenates the objects in order, so the first object is placed at address 0, and the
+	combined program is then compiled as usual which resolves every label with the ordinary relocation table.
+
+	Labels and constants that aren't exported are local to their object, if the same name is defined by more than
+	one object the local definitions are renamed (.loop in the second object becomes .loop@o2) so they don't clash. Macro
+	expansions use their own suffix (.loop@m1) and neither can be written in source so renamed names are always unique.
+*/
+
+// Object is a relocatable object produced by assembling a single file
+type Object struct {
+	Nodes []SyntaxNode
+
+	// Exports and Imports are label nodes pointing at the .global and .extern directives
+	// that declared them
+	Exports []SyntaxNode
+	Imports []SyntaxNode
+}
+
+// NewObject builds a relocatable object from a parsed program, it checks that every exported label is defined
+// and that every symbol the program refers to is either defined within it or imported
+func NewObject(nodes []SyntaxNode) (*Object, error) {
+	object := &Object{}
+	diagnostics := Diagnostics{}
+
+	for _, node := range nodes {
+		switch {
+		case node.NodeType == Directive && node.Value == ".global":
+			object.Exports = append(object.Exports, node.Children...)
+		case node.NodeType == Directive && node.Value == ".extern":
+			object.Imports = append(object.Imports, node.Children...)
+		default:
+			object.Nodes = append(object.Nodes, node)
+		}
+	}
+
+	defined := definedSymbols(object.Nodes)
+	imported := map[string]bool{}
+	for _, symbol := range object.Imports {
+		imported[symbol.Value] = true
+		if defined[symbol.Value] {
+			diagnostics = append(diagnostics, errorAtNode(symbol, `Imported label "%s" is also defined in this file`, symbol.Value))
+		}
+	}
+	for _, symbol := range object.Exports {
+		if !defined[symbol.Value] {
+			diagnostics = append(diagnostics, errorAtNode(symbol, `Exported label "%s" is not defined in this file`, symbol.Value))
+		}
+	}
+
+	forEachExpression(object.Nodes, func(node SyntaxNode, expression *string) {
+		renameSymbols(*expression, func(name string) string {
+			if defined[name] || imported[name] {
+				return name
+			} else if name[0] == '.' {
+				diagnostics = append(diagnostics, errorAtNode(node, `Undefined label "%s", labels from other files must be imported with .extern`, name))
+			} else {
+				diagnostics = append(diagnostics, errorAtNode(node, `Undefined constant "%s"`, name))
+			}
+			return name
+		})
+	})
+
+	return object, diagnostics.asError()
+}
+
+// Link combines several objects into a single program which can then be compiled, every import
+// must be exported by exactly one object
+func Link(objects []*Object) ([]SyntaxNode, error) {
+	diagnostics := Diagnostics{}
+
+	exports := map[string]SyntaxNode{}
+	for _, object := range objects {
+		for _, symbol := range object.Exports {
+			if original, ok := exports[symbol.Value]; ok {
+				diagnostic := errorAtNode(symbol, `Label "%s" is exported by more than one object`, symbol.Value)
+				diagnostic.Notes = append(diagnostic.Notes, noteAtNode(original, "previously exported here"))
+				diagnostics = append(diagnostics, diagnostic)
+				continue
+			}
+			exports[symbol.Value] = symbol
+		}
+	}
+
+	for _, object := range objects {
+		for _, symbol := range object.Imports {
+			if _, ok := exports[symbol.Value]; !ok {
+				diagnostics = append(diagnostics, errorAtNode(symbol, `Undefined external label "%s", no object exports it`, symbol.Value))
+			}
+		}
+	}
+
+	// work out which local names clash between objects
+	definitions := map[string]int{}
+	for _, object := range objects {
+		for name := range definedSymbols(object.Nodes) {
+			definitions[name]++
+		}
+	}
+
+	linked := []SyntaxNode{}
+	for i, object := range objects {
+		exported := map[string]bool{}
+		for _, symbol := range object.Exports {
+			exported[symbol.Value] = true
+		}
+
+		defined := definedSymbols(object.Nodes)
+		suffix := string(generatedSeparator) + "o" + strconv.Itoa(i+1)
+		rename := func(name string) string {
+			if defined[name] && !exported[name] && definitions[name] > 1 {
+				return name + suffix
+			}
+			return name
+		}
+
+		nodes := copyNodes(object.Nodes)
+		for j := range nodes {
+			node := &nodes[j]
+			if node.NodeType == Label {
+				node.Value = rename(node.Value)
+			} else if node.NodeType == Directive && (node.Value == ".equ" || node.Value == ".set") {
+				node.Children[0].Value = rename(node.Children[0].Value)
+			}
+		}
+		forEachExpression(nodes, func(_ SyntaxNode, expression *string) {
+			*expression = renameSymbols(*expression, rename)
+		})
+		linked = append(linked, nodes...)
+	}
+
+	return linked, diagnostics.asError()
+}
+
+// definedSymbols finds every label and constant defined within a program
+func definedSymbols(nodes []SyntaxNode) map[string]bool {
+	defined := map[string]bool{}
+	for _, node := range nodes {
+		if node.NodeType == Label {
+			defined[node.Value] = true
+		} else if node.NodeType == Directive && (node.Value == ".equ" || node.Value == ".set") {
+			defined[node.Children[0].Value] = true
+		}
+	}
+	return defined
+}
+
+// forEachExpression calls fn with every expression in the operands and arguments of a program,
+// the expression may be modified in place
+func forEachExpression(nodes []SyntaxNode, fn func(node SyntaxNode, expression *string)) {
+	for i := range nodes {
+		for j := range nodes[i].Children {
+			child := &nodes[i].Children[j]
+			for _, expression := range operandExpressions(child) {
+				fn(*child, expression)
+			}
+		}
+	}
+}
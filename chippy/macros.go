@@ -0,0 +1,184 @@
+package chippy
+
+import (
+	"regexp"
+	"strconv"
+)
+
+// maxMacroDepth is the deepest a chain of nested macro expansions may go, it stops
+// recursive macros from expanding forever
+const maxMacroDepth = 32
+
+// macro is a single macro definition, the body is kept as a list of tokens which are
+// copied into the token stream every time the macro is invoked
+type macro struct {
+	definition Token
+	params     []string
+	body       []Token
+
+	// locals are the labels defined within the body, they are renamed in every
+	// expansion so that a macro can be used more than once
+	locals map[string]bool
+}
+
+// macroExpander holds the state of the preprocessor over an entire file
+type macroExpander struct {
+	macros      map[string]*macro
+	expansions  int
+	diagnostics Diagnostics
+}
+
+// substitutionRegex matches parameter references (\name) and labels (.name) within a token
+var substitutionRegex = regexp.MustCompile(`\\\w+|\.[\w@]+`)
+
+// expandMacros is a preprocessing stage that removes macro definitions from a clean token stream
+// and replaces each macro invocation with the body of the macro, macros must be defined before they
+// are used and are invoked by writing their name at the start of a line followed by their arguments
+func expandMacros(tokens []Token) ([]Token, Diagnostics) {
+	expander := macroExpander{macros: map[string]*macro{}}
+	expanded := expander.expand(tokens, 0)
+	return expanded, expander.diagnostics
+}
+
+// expand walks a token stream, recording definitions and expanding invocations
+func (e *macroExpander) expand(tokens []Token, depth int) []Token {
+	expanded := []Token{}
+
+	for i := 0; i < len(tokens); i++ {
+		token := tokens[i]
+		isDirective := token.TokenType == DIRECTIVE
+
+		if isDirective && string(token.Value) == ".macro" {
+			i += e.define(token, tokens[i+1:])
+		} else if isDirective && string(token.Value) == ".endm" {
+			e.diagnostics = append(e.diagnostics, errorAtToken(token, `".endm" without a matching ".macro"`))
+		} else if m, ok := e.macros[string(token.Value)]; ok && token.TokenType == VALUE && (i == 0 || !sameLine(tokens[i-1], token)) {
+			args := restOfLine(token, tokens[i+1:])
+			i += len(args)
+			expanded = append(expanded, e.invoke(m, token, args, depth)...)
+		} else {
+			expanded = append(expanded, token)
+		}
+	}
+
+	return expanded
+}
+
+// define records a macro definition, it returns the number of tokens following the
+// .macro directive that belong to the definition (including the terminating .endm)
+func (e *macroExpander) define(directive Token, tokens []Token) int {
+	header := restOfLine(directive, tokens)
+	if len(header) == 0 {
+		e.diagnostics = append(e.diagnostics, errorAtToken(directive, `".macro" expects a macro name`))
+	}
+
+	// find the end of the macro, nested definitions aren't allowed
+	consumed := len(header)
+	body := []Token{}
+	terminated := false
+	for ; consumed < len(tokens) && !terminated; consumed++ {
+		token := tokens[consumed]
+		if token.TokenType == DIRECTIVE && string(token.Value) == ".endm" {
+			terminated = true
+		} else if token.TokenType == DIRECTIVE && string(token.Value) == ".macro" {
+			e.diagnostics = append(e.diagnostics, errorAtToken(token, `Macros cannot be defined within another macro`))
+		} else {
+			body = append(body, token)
+		}
+	}
+
+	if !terminated {
+		e.diagnostics = append(e.diagnostics, errorAtToken(directive, `Unterminated ".macro", expected ".endm"`))
+		return consumed
+	} else if len(header) == 0 {
+		return consumed
+	}
+
+	// validate the name and parameters of the macro
+	name := header[0]
+	m := &macro{definition: name, body: body, locals: map[string]bool{}}
+	if !identifierRegex.Match(name.Value) || name.TokenType != VALUE {
+		e.diagnostics = append(e.diagnostics, errorAtToken(name, `Invalid macro name "%s"`, name.Value))
+		return consumed
+	} else if existing, ok := e.macros[string(name.Value)]; ok {
+		diagnostic := errorAtToken(name, `Macro "%s" is already defined`, name.Value)
+		diagnostic.Notes = append(diagnostic.Notes, noteAtToken(existing.definition, "previous definition is here"))
+		e.diagnostics = append(e.diagnostics, diagnostic)
+		return consumed
+	}
+
+	for _, param := range header[1:] {
+		if !identifierRegex.Match(param.Value) {
+			e.diagnostics = append(e.diagnostics, errorAtToken(param, `Invalid macro parameter "%s"`, param.Value))
+			return consumed
+		}
+		m.params = append(m.params, string(param.Value))
+	}
+
+	// any label at the start of a line in the body is local to the macro, directives such as .byte
+	// look like labels but are classified as DIRECTIVE tokens so they're left alone
+	for i, token := range body {
+		if token.TokenType == VALUE && labelRegex.Match(token.Value) && (i == 0 || !sameLine(body[i-1], token)) {
+			m.locals[string(token.Value)] = true
+		}
+	}
+
+	e.macros[string(name.Value)] = m
+	return consumed
+}
+
+// invoke expands a single invocation of a macro, site is the token naming the macro
+// and args are the remaining tokens on its line
+func (e *macroExpander) invoke(m *macro, site Token, args []Token, depth int) []Token {
+	if depth >= maxMacroDepth {
+		e.diagnostics = append(e.diagnostics, errorAtToken(site,
+			`Macro expansion of "%s" is nested more than %d levels deep, is the macro recursive?`, site.Value, maxMacroDepth))
+		return nil
+	} else if len(args) != len(m.params) {
+		diagnostic := errorAtToken(site, `Macro "%s" expects %d argument(s) but got %d`, site.Value, len(m.params), len(args))
+		diagnostic.Notes = append(diagnostic.Notes, noteAtToken(m.definition, "macro is defined here"))
+		e.diagnostics = append(e.diagnostics, diagnostic)
+		return nil
+	}
+
+	e.expansions++
+	arguments := map[string]string{}
+	for i, param := range m.params {
+		arguments[param] = string(args[i].Value)
+	}
+
+	// body tokens keep their position within the definition so errors point at the
+	// macro, the call site is attached so they can also be reported against the invocation
+	expandedFrom := site
+	expanded := make([]Token, 0, len(m.body))
+	for _, token := range m.body {
+		value := substitutionRegex.ReplaceAllFunc(token.Value, func(match []byte) []byte {
+			name := string(match[1:])
+			if match[0] == '\\' {
+				if argument, ok := arguments[name]; ok {
+					return []byte(argument)
+				}
+			} else if m.locals[string(match)] {
+				return []byte("." + name + string(generatedSeparator) + "m" + strconv.Itoa(e.expansions))
+			}
+			return match
+		})
+
+		token.TokenType, token.Value = classifyToken(value)
+		token.expansion = e.expansions
+		token.expandedFrom = &expandedFrom
+		expanded = append(expanded, token)
+	}
+
+	// finally expand any invocations within the body
+	return e.expand(expanded, depth+1)
+}
+
+// restOfLine returns the tokens following a token that lie on the same line
+func restOfLine(token Token, tokens []Token) []Token {
+	end := 0
+	for end < len(tokens) && sameLine(token, tokens[end]) {
+		end++
+	}
+	return tokens[:end]
+}
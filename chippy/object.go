@@ -0,0 +1,226 @@
+package chippy
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+/*
+	Objects are stored as plain text, a header line followed by one record per line:
+		CHIPPYOBJ 1
+		EXPORT <label> <line> <column> <quoted file>
+		IMPORT <label> <line> <column> <quoted file>
+		NODE <type> <line> <column> <quoted file> <quoted source> <quoted value> <quoted argument> <children>
+	A NODE record is immediately followed by the records of its children (indented for readability), lines
+	and columns are 1 indexed. Blank lines and lines starting with # are ignored.
+*/
+
+const (
+	objectHeader  = "CHIPPYOBJ"
+	objectVersion = 1
+)
+
+// Write serialises the object so it can be linked later on
+func (o *Object) Write(w io.Writer) error {
+	output := bufio.NewWriter(w)
+	fmt.Fprintf(output, "%s %d\n", objectHeader, objectVersion)
+
+	for _, symbol := range o.Exports {
+		fmt.Fprintf(output, "EXPORT %s %d %d %s\n", symbol.Value, symbol.line+1, symbol.col+1, strconv.Quote(symbol.file))
+	}
+	for _, symbol := range o.Imports {
+		fmt.Fprintf(output, "IMPORT %s %d %d %s\n", symbol.Value, symbol.line+1, symbol.col+1, strconv.Quote(symbol.file))
+	}
+	for _, node := range o.Nodes {
+		writeNode(output, node, "")
+	}
+	return output.Flush()
+}
+
+func writeNode(w io.Writer, node SyntaxNode, indent string) {
+	fmt.Fprintf(w, "%sNODE %d %d %d %s %s %s %s %d\n", indent, node.NodeType, node.line+1, node.col+1,
+		strconv.Quote(node.file), strconv.Quote(node.source), strconv.Quote(node.Value), strconv.Quote(node.Argument), len(node.Children))
+	for _, child := range node.Children {
+		writeNode(w, child, indent+"    ")
+	}
+}
+
+// objectReader reads the records of an object file one at a time
+type objectReader struct {
+	scanner    *bufio.Scanner
+	lineNumber int
+}
+
+// next returns the next record, skipping blank lines and comments
+func (r *objectReader) next() (string, bool) {
+	for r.scanner.Scan() {
+		r.lineNumber++
+		line := strings.TrimSpace(r.scanner.Text())
+		if line != "" && !strings.HasPrefix(line, "#") {
+			return line, true
+		}
+	}
+	return "", false
+}
+
+// ReadObject parses an object written by Write
+func ReadObject(r io.Reader) (*Object, error) {
+	reader := &objectReader{scanner: bufio.NewScanner(r)}
+	object := &Object{}
+
+	line, ok := reader.next()
+	if fields := strings.Fields(line); !ok || len(fields) != 2 || fields[0] != objectHeader || fields[1] != strconv.Itoa(objectVersion) {
+		return nil, fmt.Errorf("line %d: not a version %d chippy object", reader.lineNumber, objectVersion)
+	}
+
+	for line, ok := reader.next(); ok; line, ok = reader.next() {
+		fields := strings.SplitN(line, " ", 5)
+
+		var err error
+		switch {
+		case (fields[0] == "EXPORT" || fields[0] == "IMPORT") && len(fields) == 5:
+			symbol := SyntaxNode{NodeType: Label, Value: fields[1], source: fields[1]}
+			if symbol.line, err = strconv.Atoi(fields[2]); err != nil {
+				break
+			}
+			if symbol.col, err = strconv.Atoi(fields[3]); err != nil {
+				break
+			}
+			if symbol.file, err = strconv.Unquote(fields[4]); err != nil {
+				break
+			}
+			symbol.line, symbol.col = symbol.line-1, symbol.col-1
+
+			if fields[0] == "EXPORT" {
+				object.Exports = append(object.Exports, symbol)
+			} else {
+				object.Imports = append(object.Imports, symbol)
+			}
+		case fields[0] == "NODE":
+			var node SyntaxNode
+			if node, err = reader.readNode(line); err == nil {
+				err = checkNode(node)
+			}
+			object.Nodes = append(object.Nodes, node)
+		default:
+			err = fmt.Errorf("unrecognised record %q", line)
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", reader.lineNumber, err)
+		}
+	}
+
+	if err := reader.scanner.Err(); err != nil {
+		return nil, err
+	}
+	return object, nil
+}
+
+// readNode parses a NODE record along with the records of its children
+func (r *objectReader) readNode(line string) (SyntaxNode, error) {
+	node := SyntaxNode{}
+	children := 0
+	_, err := fmt.Sscanf(line, "NODE %d %d %d %q %q %q %q %d", &node.NodeType, &node.line, &node.col,
+		&node.file, &node.source, &node.Value, &node.Argument, &children)
+	if err != nil {
+		return node, fmt.Errorf("malformed node %q: %w", line, err)
+	}
+	node.line, node.col = node.line-1, node.col-1
+
+	for i := 0; i < children; i++ {
+		childLine, ok := r.next()
+		if !ok {
+			return node, fmt.Errorf("expected %d children but the file ended", children)
+		}
+		child, err := r.readNode(childLine)
+		if err != nil {
+			return node, err
+		}
+		node.Children = append(node.Children, child)
+	}
+	return node, nil
+}
+
+// checkNode checks that a node read from an object has the shape the parser would have given it, the
+// linker and compiler trust the nodes they're given so a malformed object must be caught here
+func checkNode(node SyntaxNode) error {
+	for _, child := range node.Children {
+		if len(child.Children) != 0 {
+			return fmt.Errorf("the operand %q of %q has operands of its own", child.Value, node.Value)
+		}
+	}
+
+	switch node.NodeType {
+	case Label:
+		if !labelRegex.MatchString(node.Value) || len(node.Children) != 0 {
+			return fmt.Errorf("malformed label %q", node.Value)
+		}
+
+	case Instruction:
+		opcode, ok := lookupOpcode(node.Value)
+		if !ok {
+			return fmt.Errorf("unknown instruction %q", node.Value)
+		}
+		accepted := operandTypes(opcode)
+		if len(node.Children) != len(accepted) {
+			return fmt.Errorf("%q expects %d operand(s) but has %d", node.Value, len(accepted), len(node.Children))
+		}
+		for i, child := range node.Children {
+			if child.NodeType&accepted[i] == 0 || !isSingleNodeType(child.NodeType) {
+				return fmt.Errorf("invalid operand %q for %q", child.source, node.Value)
+			}
+			if child.NodeType == RegisterValue || child.NodeType == RegisterRelativeValue {
+				if _, ok := REGISTERS[child.Value]; !ok {
+					return fmt.Errorf("unknown register %q in %q", child.Value, node.Value)
+				}
+			}
+			for _, expression := range operandExpressions(&child) {
+				if err := validateExpression(*expression); err != nil {
+					return err
+				}
+			}
+		}
+
+	case Directive:
+		spec, ok := DIRECTIVES[node.Value]
+		if !ok {
+			return fmt.Errorf("unknown directive %q", node.Value)
+		}
+		if len(node.Children) < spec.minArgs || (spec.maxArgs != unlimitedArgs && len(node.Children) > spec.maxArgs) {
+			return fmt.Errorf("%q has the wrong number of arguments (%d)", node.Value, len(node.Children))
+		}
+		for i, child := range node.Children {
+			if spec.named && i == 0 {
+				if child.NodeType != Identifier || !identifierRegex.MatchString(child.Value) {
+					return fmt.Errorf("invalid constant name %q for %q", child.Value, node.Value)
+				}
+			} else if child.NodeType&spec.argTypes == 0 || !isSingleNodeType(child.NodeType) {
+				return fmt.Errorf("invalid argument %q for %q", child.source, node.Value)
+			}
+		}
+
+	default:
+		return fmt.Errorf("unexpected node of type %d", node.NodeType)
+	}
+	return nil
+}
+
+// isSingleNodeType determines if a node type is exactly one of the recognised node types rather than a mask of several
+func isSingleNodeType(kind nodeType) bool {
+	return kind != 0 && kind&(kind-1) == 0
+}
+
+// LoadObject reads an object from a file on disk
+func LoadObject(path string) (*Object, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return ReadObject(file)
+}
@@ -0,0 +1,65 @@
+package chippy
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestObjectRoundTrip(t *testing.T) {
+	source := ".extern .print\n.global .main\n.equ SIZE, 4\n.main\n\tmov $r1, #SIZE\n\tldr $r2, 2+$r1\n" +
+		"\tjmp .main\n.table\n\t.byte 1, 2\n\t.asciiz \"hi\"\n\t.space SIZE, 255\n"
+	nodes, err := parse(source)
+	if err != nil {
+		t.Fatal(err)
+	}
+	object, err := NewObject(nodes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buffer bytes.Buffer
+	if err := object.Write(&buffer); err != nil {
+		t.Fatal(err)
+	}
+	read, err := ReadObject(&buffer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(read.Nodes) != len(object.Nodes) {
+		t.Errorf("got %d nodes, want %d", len(read.Nodes), len(object.Nodes))
+	}
+}
+
+func TestMalformedObjects(t *testing.T) {
+	cases := map[string]string{
+		"instruction without operands": `NODE 0 1 1 "a" "mov" "mov" "" 0`,
+		"instruction with extra operands": `NODE 0 1 1 "a" "mov" "mov" "" 3
+			NODE 2 1 5 "a" "$r1" "r1" "" 0
+			NODE 1 1 10 "a" "#1" "1" "" 0
+			NODE 1 1 13 "a" "#2" "2" "" 0`,
+		"operand of the wrong type": `NODE 0 1 1 "a" "mov" "mov" "" 2
+			NODE 1 1 5 "a" "#1" "1" "" 0
+			NODE 1 1 10 "a" "#1" "1" "" 0`,
+		"unknown register": `NODE 0 1 1 "a" "mov" "mov" "" 2
+			NODE 2 1 5 "a" "$r99" "r99" "" 0
+			NODE 1 1 10 "a" "#1" "1" "" 0`,
+		"unknown instruction":      `NODE 0 1 1 "a" "nope" "nope" "" 0`,
+		"constant without a value": `NODE 64 1 1 "a" ".equ" ".equ" "" 0`,
+		"constant without a name": `NODE 64 1 1 "a" ".equ" ".equ" "" 2
+			NODE 1 1 6 "a" "1" "1" "" 0
+			NODE 1 1 9 "a" "2" "2" "" 0`,
+		"too many arguments": `NODE 64 1 1 "a" ".org" ".org" "" 2
+			NODE 1 1 6 "a" "1" "1" "" 0
+			NODE 1 1 9 "a" "2" "2" "" 0`,
+		"unknown directive": `NODE 64 1 1 "a" ".nope" ".nope" "" 0`,
+		"malformed label":   `NODE 16 1 1 "a" "main" "main" "" 0`,
+		"unknown node type": `NODE 1 1 1 "a" "1" "1" "" 0`,
+	}
+	for name, nodes := range cases {
+		t.Run(name, func(t *testing.T) {
+			if _, err := ReadObject(strings.NewReader("CHIPPYOBJ 1\n" + nodes + "\n")); err == nil {
+				t.Error("got no error")
+			}
+		})
+	}
+}
@@ -6,13 +6,21 @@ import (
 	"fmt"
 )
 
-// Parse takes a bufio reader (stream) and turns it into a list to tokens
-func Parse(stream bufio.Reader) []SyntaxNode {
-	tokens := cleanTokens(
-		tokeniseFileStream(stream))
+// Parse takes a bufio reader (stream) and turns it into a list to tokens, the file name
+// is used for reporting diagnostics and resolving included files, if any errors are found the returned error is
+// a Diagnostics value containing every problem in the file
+func Parse(fileName string, stream bufio.Reader) ([]SyntaxNode, error) {
+	tokens, diagnostics := tokeniseFile(fileName, stream)
 
-	// single pass to clean nodes
-	return transform(tokens)
+	// includes and macros are expanded before the tokens are transformed so the
+	// rest of the assembler never sees them
+	tokens, includeDiagnostics := expandIncludes(tokens, []string{fileName})
+	tokens, macroDiagnostics := expandMacros(tokens)
+	nodes, transformDiagnostics := transform(tokens)
+
+	diagnostics = append(diagnostics, includeDiagnostics...)
+	diagnostics = append(diagnostics, macroDiagnostics...)
+	return nodes, append(diagnostics, transformDiagnostics...).asError()
 }
 
 // printSyntaxNodes is for debugging purposes, it just prints the syntax nodes in a
@@ -26,116 +34,243 @@ func PrintSyntaxNodes(syntaxNodes []SyntaxNode) {
 	}
 }
 
-// transform takes a stream of tokes and transforms them into a set
-// of "syntax nodes" this part is mostly the identification of register addressing modes
-// as well as lables, note that this function assumes the token stream is CLEAN
-func transform(tokens []Token) []SyntaxNode {
+/*
+	The parser is a line oriented recursive descent parser over the cleaned token stream, the grammar is:
+		program     := line*
+		line        := label* statement? END_OF_LINE
+		label       := "." identifier
+		statement   := instruction | directive
+		instruction := mnemonic (operand ","?)*
+		directive   := "." name (argument ","?)*
+		operand     := register | register_relative | address | pc_relative | immediate | expression
+	Newlines and commas are dropped when the tokens are cleaned so a line is the run of tokens written on the
+	same source line (see sameLine), an instruction must be given exactly as many operands as it takes and a
+	statement can't be followed by anything else on its line. Operands are described in tokens.go and their
+	expressions in expressions.go.
+
+	Each line becomes its labels followed by the statement's node, an instruction or directive node holds its
+	operands as children, every node records the span of source it was parsed from.
+*/
+
+// parser holds the state of a token stream being parsed
+type parser struct {
+	tokens      []Token
+	position    int
+	diagnostics Diagnostics
+}
+
+// transform takes a stream of tokens and parses it into a list of syntax nodes, note that this
+// function assumes the token stream is CLEAN, any malformed lines are reported as diagnostics and left
+// out of the output
+func transform(tokens []Token) ([]SyntaxNode, Diagnostics) {
+	p := parser{tokens: tokens}
+	return p.parseProgram(), p.diagnostics
+}
+
+// parseProgram parses every line in the token stream
+func (p *parser) parseProgram() []SyntaxNode {
 	nodes := []SyntaxNode{}
-	for i := 0; i < len(tokens); i++ {
-		token := tokens[i]
-
-		// we want to consume the current token and any subsequent tokens
-		// if this is an instruction token we consume the number of arguments
-		// the instruction expects
-		if token.TokenType == INSTRUCTION {
-			// feels like converting to a string is a bad idea :L
-			toConsume := OPCODES[string(token.Value)][NUMARGS]
-			if i+int(toConsume+1) > len(tokens) {
-				panic(fmt.Sprintf(`Error - Unexpected EOF on line %d.`, token.line+1))
-			}
+	for p.position < len(p.tokens) {
+		nodes = append(nodes, p.parseLine(p.nextLine())...)
+	}
+	return nodes
+}
 
-			nodes = append(nodes, cleanSyntaxNode(SyntaxNode{
-				NodeType: Instruction,
-				Value:    string(token.Value),
-				Children: consumeChildren(tokens[i+1:], int(toConsume)),
-				line:     token.line, col: token.column,
-			}))
-
-			i += int(toConsume)
-		} else {
-			// after cleaning we only reach here if and onlf if this is a value token
-			// either this is a label which we admit or we throw an error
-			matches, matched := matchNamedGroups(labelRegex, token.Value)
-			if !matched {
-				panic(fmt.Sprintf(`Error - Unexpected identifier "%s" on line %d column %d.`, token.Value, token.line, token.column))
-			}
+// nextLine consumes the tokens making up the next line
+func (p *parser) nextLine() []Token {
+	start := p.position
+	for p.position < len(p.tokens) && sameLine(p.tokens[start], p.tokens[p.position]) {
+		p.position++
+	}
+	return p.tokens[start:p.position]
+}
 
-			nodes = append(nodes, cleanSyntaxNode(SyntaxNode{
-				NodeType: Label,
-				Value:    string(matches["Value"]),
-				line:     token.line, col: token.column,
-			}))
+// parseLine parses a line's leading labels and then its statement, if any
+func (p *parser) parseLine(line []Token) []SyntaxNode {
+	nodes := []SyntaxNode{}
+	for len(line) != 0 && line[0].TokenType == VALUE {
+		label, ok := p.parseLabel(line[0])
+		if !ok {
+			return nodes
 		}
+		nodes = append(nodes, label)
+		line = line[1:]
+	}
+	if len(line) == 0 {
+		return nodes
 	}
 
+	switch statement := line[0]; statement.TokenType {
+	case INSTRUCTION:
+		if node, ok := p.parseInstruction(statement, line[1:]); ok {
+			nodes = append(nodes, node)
+		}
+	case DIRECTIVE:
+		if node, ok := p.parseDirective(statement, line[1:]); ok {
+			nodes = append(nodes, node)
+		}
+	}
 	return nodes
 }
 
-// consumeChildren consumes the children of a INSTRUCTION node
-func consumeChildren(tokens []Token, toConsume int) []SyntaxNode {
-	children := []SyntaxNode{}
-	for j := 0; j < toConsume; j++ {
-		child := tokens[j]
-		if child.TokenType == INSTRUCTION {
-			panic(fmt.Sprintf(`Error - Unexpected instruction "%s" on line %d cloumn %d.`, child.Value, child.line, child.column))
+// parseLabel parses a label definition, anything else at the start of a line is an error
+func (p *parser) parseLabel(token Token) (SyntaxNode, bool) {
+	matches, matched := matchNamedGroups(labelRegex, token.Value)
+	if !matched {
+		p.diagnostics = append(p.diagnostics, errorAtToken(token, `Unexpected identifier "%s"`, token.Value))
+		return SyntaxNode{}, false
+	}
+
+	return cleanSyntaxNode(SyntaxNode{
+		NodeType: Label,
+		Value:    string(matches["Value"]),
+		file:     token.file, source: string(token.Value),
+		line: token.line, col: token.column, endCol: token.endColumn,
+		expandedFrom: token.expandedFrom,
+	}), true
+}
+
+// parseInstruction parses an instruction along with its operands, the rest of the line must
+// hold exactly the number of operands the instruction takes
+func (p *parser) parseInstruction(instruction Token, operands []Token) (SyntaxNode, bool) {
+	opcode, _ := lookupOpcode(string(instruction.Value))
+	expected := len(operandTypes(opcode))
+	if !p.checkStatementEnd(instruction, operands) {
+		return SyntaxNode{}, false
+	}
+	if len(operands) < expected {
+		p.diagnostics = append(p.diagnostics, errorAtToken(instruction,
+			`Missing operand, "%s" expects %d operand(s) but got %d`, instruction.Value, expected, len(operands)))
+		return SyntaxNode{}, false
+	} else if len(operands) > expected {
+		p.diagnostics = append(p.diagnostics, errorAtToken(operands[expected],
+			`Unexpected operand "%s", "%s" expects %d operand(s)`, operands[expected].Value, instruction.Value, expected))
+		return SyntaxNode{}, false
+	}
+
+	node := SyntaxNode{
+		NodeType: Instruction,
+		Value:    string(instruction.Value),
+		file:     instruction.file, source: string(instruction.Value),
+		line: instruction.line, col: instruction.column, endCol: lineEnd(instruction, operands),
+		expandedFrom: instruction.expandedFrom,
+	}
+	ok := true
+	for _, operand := range operands {
+		child, err := createValueNode(operand)
+		if err != nil {
+			p.diagnostics = append(p.diagnostics, errorAtToken(operand, "%s", err))
+			ok = false
+			continue
 		}
+		node.Children = append(node.Children, child)
+	}
+	return cleanSyntaxNode(node), ok
+}
 
-		childNode, isValid := createValueNode(child)
-		if !isValid {
-			panic(fmt.Sprintf(`Error - Invalid identifier "%s" on line %d column %d.`, child.Value, child.line, child.column))
+// parseDirective parses a directive along with its arguments, see directives.go
+func (p *parser) parseDirective(directive Token, arguments []Token) (SyntaxNode, bool) {
+	if !p.checkStatementEnd(directive, arguments) {
+		return SyntaxNode{}, false
+	}
+	node, diagnostics := consumeDirective(directive, arguments)
+	node.endCol = lineEnd(directive, arguments)
+	p.diagnostics = append(p.diagnostics, diagnostics...)
+	return node, len(diagnostics) == 0
+}
+
+// checkStatementEnd makes sure there's only a single statement on a line, ie. none of the operands
+// following a statement are instructions or directives themselves
+func (p *parser) checkStatementEnd(statement Token, operands []Token) bool {
+	for _, operand := range operands {
+		if operand.TokenType == INSTRUCTION || operand.TokenType == DIRECTIVE {
+			p.diagnostics = append(p.diagnostics, errorAtToken(operand,
+				`Unexpected "%s" after "%s", expected the end of the line`, operand.Value, statement.Value))
+			return false
 		}
-		children = append(children, cleanSyntaxNode(childNode))
 	}
+	return true
+}
 
-	return children
+// lineEnd determines the column just past the end of a statement
+func lineEnd(statement Token, operands []Token) int {
+	if len(operands) == 0 {
+		return statement.endColumn
+	}
+	return operands[len(operands)-1].endColumn
 }
 
 // createValueNode takes a token and returns a SyntaxNode of the corresponding type
-// it also returns a boolean indicating of the value is recognised
-func createValueNode(token Token) (SyntaxNode, bool) {
-	for nodeType, r := range recognisedValueTypes {
+// it also returns an error if the value isn't recognised or contains an invalid expression
+func createValueNode(token Token) (SyntaxNode, error) {
+	for _, valueType := range recognisedValueTypes {
 		// try and match and extract the substrings
-		matches, matched := matchNamedGroups(r, token.Value)
-		if !matched {
+		matches, matched := matchNamedGroups(valueType.regex, token.Value)
+		if !matched || (valueType.nodeType == PCRelativeValue && !isBalanced(matches["Value"])) {
 			continue
 		}
 
 		// construct a new syntax node now :D
 		// if theres an argument node return that too
-		node := SyntaxNode{
-			NodeType: nodeType,
+		node := cleanSyntaxNode(SyntaxNode{
+			NodeType: valueType.nodeType,
 			Value:    string(matches["Value"]),
-		}
+			file:     token.file,
+			source:   string(token.Value),
+			line:     token.line,
+			col:      token.column,
+			endCol:   token.endColumn,
+
+			expandedFrom: token.expandedFrom,
+		})
 		if val, exists := matches["Argument"]; exists {
 			node.Argument = string(val)
 		}
-		return node, true
+
+		// #(x) is only PC relative when x is a single value, otherwise something like #(BUF_SIZE*2)
+		// would silently become a PC relative operand when an immediate was meant
+		if node.NodeType == PCRelativeValue && !isSingleValue(node.Value) {
+			return node, fmt.Errorf(`Ambiguous operand "%s", #(x) is PC relative and only takes a single value, write #+(%s) for an immediate`,
+				token.Value, node.Value)
+		}
+
+		// finally make sure any expressions in the value are well formed
+		for _, expression := range operandExpressions(&node) {
+			if err := validateExpression(*expression); err != nil {
+				return node, err
+			}
+		}
+		return node, nil
+	}
+	return SyntaxNode{}, fmt.Errorf(`Invalid identifier "%s"`, token.Value)
+}
+
+// isBalanced determines if the parentheses in an expression are balanced, it's used to tell
+// apart PC relative values #(x) from immediate values such as #(x)+(y)
+func isBalanced(expression []byte) bool {
+	depth := 0
+	for _, c := range expression {
+		if c == '(' {
+			depth++
+		} else if c == ')' {
+			depth--
+		}
+		if depth < 0 {
+			return false
+		}
 	}
-	return SyntaxNode{}, false
+	return depth == 0
 }
 
 // cleanTokens takes an array of tokens and cleans them by removing
-// empty tokes, comments and newlines
+// empty tokens, commas and newlines
 func cleanTokens(tokens []Token) []Token {
-	withinComment := false
 	return mapOnto(tokens, func(token Token) (Token, bool) {
-
-		shouldAdmit := false
-		if token.TokenType == COMMENT {
-			withinComment = true
-		} else if token.TokenType == NEWLINE {
-			withinComment = false
-		} else {
-			isMeaningful := token.Value != nil &&
-				len(bytes.TrimSpace(token.Value)) != 0 &&
-				!withinComment
-
-			// note that we discard comma tokens, they dont have any
-			// real meaning and only serve as a convenient separator
-			shouldAdmit = isMeaningful
-		}
-
-		return token, shouldAdmit
+		// note that we discard comma tokens, they dont have any
+		// real meaning and only serve as a convenient separator
+		isMeaningful := token.TokenType != NEWLINE && token.TokenType != COMMA &&
+			len(bytes.TrimSpace(token.Value)) != 0
+		return token, isMeaningful
 	})
 }
 
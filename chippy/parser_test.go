@@ -0,0 +1,178 @@
+package chippy
+
+import (
+	"bufio"
+	"cheepcheep/isa"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func parse(source string) ([]SyntaxNode, error) {
+	return Parse("test.chippy", *bufio.NewReader(strings.NewReader(source)))
+}
+
+// assertParseError checks that source fails to parse with a single error at line:column
+// whose message contains message
+func assertParseError(t *testing.T, source string, line, column int, message string) {
+	t.Helper()
+	_, err := parse(source)
+	var diagnostics Diagnostics
+	if !errors.As(err, &diagnostics) || len(diagnostics) != 1 {
+		t.Fatalf("got %v, want a single error", err)
+	}
+	got := diagnostics[0]
+	if got.Line != line || got.Column != column || !strings.Contains(got.Message, message) {
+		t.Errorf("got %s, want an error at %d:%d containing %q", got.Error(), line, column, message)
+	}
+}
+
+func TestParseLines(t *testing.T) {
+	nodes, err := parse(".start .loop add $r1, #1\n\tjmp .loop\n.data .byte 1, 2\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []struct {
+		nodeType      nodeType
+		value         string
+		children      int
+		line, col, to int
+	}{
+		{Label, ".start", 0, 0, 0, 6},
+		{Label, ".loop", 0, 0, 7, 12},
+		{Instruction, "ADD", 2, 0, 13, 24},
+		{Instruction, "JMP", 1, 1, 1, 10},
+		{Label, ".data", 0, 2, 0, 5},
+		{Directive, ".byte", 2, 2, 6, 16},
+	}
+	if len(nodes) != len(want) {
+		t.Fatalf("got %d nodes, want %d", len(nodes), len(want))
+	}
+	for i, node := range nodes {
+		w := want[i]
+		if node.NodeType != w.nodeType || node.Value != w.value || len(node.Children) != w.children ||
+			node.line != w.line || node.col != w.col || node.endCol != w.to {
+			t.Errorf("node %d is %s (type %d, %d children) at %d:%d-%d, want %s (type %d, %d children) at %d:%d-%d",
+				i, node.Value, node.NodeType, len(node.Children), node.line, node.col, node.endCol,
+				w.value, w.nodeType, w.children, w.line, w.col, w.to)
+		}
+	}
+}
+
+func TestMissingOperand(t *testing.T) {
+	// the label on the following line must not be taken as the missing operand
+	assertParseError(t, "ldr $r1\n.label\nhlt\n", 1, 1, `"LDR" expects 2 operand(s) but got 1`)
+}
+
+func TestExtraOperand(t *testing.T) {
+	assertParseError(t, "add $r1, #1, #2\n", 1, 14, `Unexpected operand "#2"`)
+	assertParseError(t, "hlt $r1\n", 1, 5, `Unexpected operand "$r1"`)
+}
+
+func TestOneStatementPerLine(t *testing.T) {
+	assertParseError(t, "mov $r1, #1 hlt\n", 1, 13, `Unexpected "HLT" after "MOV"`)
+	assertParseError(t, ".byte 1 .word 2\n", 1, 9, `Unexpected ".word" after ".byte"`)
+}
+
+func TestUnexpectedIdentifier(t *testing.T) {
+	assertParseError(t, "bogus\n", 1, 1, `Unexpected identifier "bogus"`)
+}
+
+func TestPCRelativeOperands(t *testing.T) {
+	nodes, err := parse(".equ OFFSET, 8\nldr $r1, #(-4)\nldr $r2, #(OFFSET)\nldr $r3, #+(OFFSET*2)\nldr $r4, #(OFFSET*2)+1\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []nodeType{PCRelativeValue, PCRelativeValue, ImmediateValue, ImmediateValue}
+	for i, node := range nodes[1:] {
+		if got := node.Children[1].NodeType; got != want[i] {
+			t.Errorf("operand %q parsed as type %d, want %d", node.Children[1].source, got, want[i])
+		}
+	}
+
+	// a parenthesised expression is ambiguous, it must not be quietly assembled as PC relative
+	assertParseError(t, ".equ BUF_SIZE, 16\nldr $r1, #(BUF_SIZE*2)\n", 2, 10, `Ambiguous operand "#(BUF_SIZE*2)"`)
+}
+
+func TestOperandTypesMatchTheISA(t *testing.T) {
+	for opcode, info := range isa.OPCODES {
+		flexible := false
+		for _, kind := range info.Operands {
+			flexible = flexible || kind == isa.FlexibleOperand
+		}
+		if _, ok := FLEXIBLE_OPERANDS[opcode]; ok != flexible {
+			t.Errorf("%s has a flexible operand: %t, but an entry in FLEXIBLE_OPERANDS: %t", info.Mnemonic, flexible, ok)
+		}
+	}
+}
+
+func TestAliases(t *testing.T) {
+	for alias, opcode := range isa.ALIASES {
+		nodes, err := parse(strings.ToLower(alias) + " [0]\n")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, _ := lookupOpcode(nodes[0].Value); got != opcode {
+			t.Errorf("%s assembled as %s, want %s", alias, got, opcode)
+		}
+	}
+}
+
+func TestGeneratedNamesDontClash(t *testing.T) {
+	// the first object expands a macro twice and defines .loop itself, the second object defines
+	// .loop as well, every one of them must end up with its own name
+	macroSource := ".macro spin\n.loop\n\tjmp .loop\n.endm\n\tspin\n\tspin\n.loop\n\tjmp .loop\n"
+	objects := []*Object{}
+	for _, source := range []string{macroSource, ".loop\n\tjmp .loop\n"} {
+		nodes, err := parse(source)
+		if err != nil {
+			t.Fatal(err)
+		}
+		object, err := NewObject(nodes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		objects = append(objects, object)
+	}
+	linked, err := Link(objects)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	labels := map[string]bool{}
+	for _, node := range linked {
+		if node.NodeType == Label {
+			if labels[node.Value] {
+				t.Errorf("%s is defined more than once", node.Value)
+			}
+			labels[node.Value] = true
+		}
+	}
+	if len(labels) != 4 {
+		t.Errorf("got labels %v, want 4 distinct labels", labels)
+	}
+}
+
+func TestMacroDataDirectives(t *testing.T) {
+	nodes, err := parse(".macro data\n.table\n\t.byte 1, 2\n\t.word 3\n.endm\n\tdata\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{".table@m1", ".byte", ".word"}
+	if len(nodes) != len(want) {
+		t.Fatalf("got %d nodes, want %d", len(nodes), len(want))
+	}
+	for i, node := range nodes {
+		if node.Value != want[i] {
+			t.Errorf("node %d is %s, want %s", i, node.Value, want[i])
+		}
+	}
+}
+
+func TestGeneratedSeparatorIsReserved(t *testing.T) {
+	assertParseError(t, ".loop@m1\n\thlt\n", 1, 6, `Unexpected "@"`)
+	if _, err := parse(".ascii \"a@b\"\n.byte '@'\n"); err != nil {
+		t.Errorf("@ within literals was rejected: %s", err)
+	}
+}
@@ -0,0 +1,172 @@
+package chippy
+
+import "strconv"
+
+// Resolution happens over two passes, the first (computeRelocationTable) lays out the program, working out
+// the address of every label along with the value of every constant and the arguments of any directive that
+// changes the layout (.space and .org), the second (resolveExpressions) then evaluates every remaining
+// expression now that the address of every label is known
+// Evaluated expressions are replaced by their value in decimal, so the rest of the compiler never has to
+// deal with them
+
+// constantTable tracks the named constants defined with .equ and .set
+type constantTable struct {
+	values      map[string]int64
+	redefinable map[string]bool
+}
+
+func newConstantTable() constantTable {
+	return constantTable{values: map[string]int64{}, redefinable: map[string]bool{}}
+}
+
+// define defines a constant, returning false if it was already defined with .equ
+func (c constantTable) define(name string, value int64, redefinable bool) bool {
+	if _, exists := c.values[name]; exists && (!redefinable || !c.redefinable[name]) {
+		return false
+	}
+	c.values[name] = value
+	c.redefinable[name] = redefinable
+	return true
+}
+
+// lookupIn builds a function that resolves symbols in expressions, names starting with a dot are labels
+// while everything else is a constant
+func lookupIn(relocationTable map[string]uint16, constants map[string]int64) symbolLookup {
+	return func(name string) (int64, bool) {
+		if name[0] == '.' {
+			address, ok := relocationTable[name]
+			return int64(address), ok
+		}
+		value, ok := constants[name]
+		return value, ok
+	}
+}
+
+// note on addresses: addresses are all 16 bit unsigned integers
+// computeRelocationTable returns a copy of the nodes where constant definitions and the arguments of .space
+// and .org have been evaluated, alongside the address of every label
+func computeRelocationTable(nodes []SyntaxNode) ([]SyntaxNode, map[string]uint16, Diagnostics) {
+	var currentAddr int = 0
+	var relocationTable = make(map[string]uint16)
+	var definitions = make(map[string]SyntaxNode)
+	constants := newConstantTable()
+	diagnostics := Diagnostics{}
+
+	resolved := copyNodes(nodes)
+	for i := range resolved {
+		node := &resolved[i]
+		if node.NodeType == Label {
+			// resolve this label by first checking if its been relocated yet
+			if original, ok := definitions[node.Value]; ok {
+				diagnostics = append(diagnostics, errorAtNode(*node, `Duplicate definition of label "%s", first defined on line %d`,
+					node.Value, original.line+1))
+			} else {
+				relocationTable[node.Value] = uint16(currentAddr)
+				definitions[node.Value] = *node
+			}
+		} else if node.NodeType == Directive {
+			diagnostics = append(diagnostics, resolveLayoutDirective(node, relocationTable, constants)...)
+		}
+
+		size := nodeSize(*node, uint16(currentAddr))
+		if size < 0 {
+			diagnostics = append(diagnostics, errorAtNode(*node, `Cannot move the location counter backwards from 0x%04x`, currentAddr))
+			continue
+		}
+
+		currentAddr += size
+		if currentAddr > 0x10000 {
+			diagnostics = append(diagnostics, errorAtNode(*node, `Program does not fit in the 16 bit address space`))
+			break
+		}
+	}
+	return resolved, relocationTable, diagnostics
+}
+
+// resolveLayoutDirective evaluates the arguments of a directive that defines a constant or affects the
+// layout of the program, only labels and constants defined so far can be referred to
+func resolveLayoutDirective(node *SyntaxNode, relocationTable map[string]uint16, constants constantTable) Diagnostics {
+	diagnostics := Diagnostics{}
+	lookup := lookupIn(relocationTable, constants.values)
+
+	switch node.Value {
+	case ".equ", ".set":
+		name := node.Children[0].Value
+		value, err := evaluateExpression(node.Children[1].Value, lookup)
+		if err != nil {
+			diagnostics = append(diagnostics, errorAtNode(node.Children[1], "%s", err))
+		}
+		node.Children[1].Value = strconv.FormatInt(value, 10)
+
+		if !constants.define(name, value, node.Value == ".set") {
+			diagnostics = append(diagnostics, errorAtNode(node.Children[0], `Duplicate definition of constant "%s"`, name))
+		}
+
+	case ".space", ".org":
+		spec := DIRECTIVES[node.Value]
+		for i := range node.Children {
+			child := &node.Children[i]
+			value, err := evaluateExpression(child.Value, lookup)
+			if err == nil {
+				_, err = parseDataValue(strconv.FormatInt(value, 10), spec.bits[min(i, len(spec.bits)-1)], spec.signed)
+			}
+
+			// on failure we just use 0 so the rest of the program can still be checked
+			if err != nil {
+				diagnostics = append(diagnostics, errorAtNode(*child, "%s", err))
+				value = 0
+			}
+			child.Value = strconv.FormatInt(value, 10)
+		}
+	}
+	return diagnostics
+}
+
+// resolveExpressions evaluates every remaining expression in the program, the nodes are modified in place
+// so they must be the copy returned by computeRelocationTable
+func resolveExpressions(nodes []SyntaxNode, relocationTable map[string]uint16) Diagnostics {
+	diagnostics := Diagnostics{}
+
+	// constants defined with .equ can be used anywhere, while constants defined with .set take
+	// the value of their most recent definition
+	constants := map[string]int64{}
+	for _, node := range nodes {
+		if node.NodeType == Directive && node.Value == ".equ" {
+			constants[node.Children[0].Value], _ = strconv.ParseInt(node.Children[1].Value, 10, 64)
+		}
+	}
+	lookup := lookupIn(relocationTable, constants)
+
+	for i := range nodes {
+		node := &nodes[i]
+		switch {
+		case node.NodeType == Directive && node.Value == ".set":
+			constants[node.Children[0].Value], _ = strconv.ParseInt(node.Children[1].Value, 10, 64)
+			continue
+		case node.NodeType == Directive && node.Value != ".byte" && node.Value != ".word":
+			continue
+		}
+
+		for j := range node.Children {
+			child := &node.Children[j]
+			for _, expression := range operandExpressions(child) {
+				value, err := evaluateExpression(*expression, lookup)
+				if err != nil {
+					diagnostics = append(diagnostics, errorAtNode(*child, "%s", err))
+				}
+				*expression = strconv.FormatInt(value, 10)
+			}
+		}
+	}
+	return diagnostics
+}
+
+// copyNodes deep copies a list of nodes so they can be modified without affecting the caller
+func copyNodes(nodes []SyntaxNode) []SyntaxNode {
+	copied := make([]SyntaxNode, len(nodes))
+	for i, node := range nodes {
+		copied[i] = node
+		copied[i].Children = copyNodes(node.Children)
+	}
+	return copied
+}
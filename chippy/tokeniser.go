@@ -2,126 +2,218 @@ package chippy
 
 import (
 	"bufio"
-	"bytes"
-	"regexp"
 	"strings"
 )
 
+/**
+The lexer:
+	- Source is read a byte at a time so files of any size (and tokens of any length) can be tokenised
+	- Tokens are separated by whitespace (spaces, tabs, ...) and commas, newlines (\n or \r\n) end the current line
+	- Within string/char literals and parentheses whitespace and commas don't end a token, this lets expressions contain
+	  spaces, a token always ends at the end of a line though
+	- Comments start with ; or // and run to the end of the line, block comments are C style (slash star ... star slash) and may span lines
+	- @ is only allowed within string/char literals, it is reserved for names generated by macros and the linker (see tokens.go)
+	- Every token records the line and column it starts on along with the column just past its end, all 0 indexed
+*/
+
+// lexer holds the state of a stream being tokenised
+type lexer struct {
+	stream *bufio.Reader
+	tokens []Token
+
+	// position of the next byte in the stream
+	line   int
+	column int
+
+	diagnostics Diagnostics
+}
+
 // tokeniseFileStream reads a file stream and converts it to an array
 // of tokens, it takes a stream as allocating a buffer in memory is obviously
 // too memory intensive
-func tokeniseFileStream(stream bufio.Reader) []Token {
-	// buffer for storing the current token we are constructing
-	tokenBuffer := [100]byte{}
-	tokenSize := 0
-	tokens := []Token{}
-
-	// for book-keeping the line and column count
-	columnCount := 0
-	lineCount := 0
-
-	for c, err := stream.ReadByte(); err == nil; c, err = stream.ReadByte() {
-		// we trigger the evaluation of the troken buffer if we arrive at a separator
-		if c == ' ' || c == '\n' || c == ',' {
-			tokenBuffer[tokenSize] = 0
-
-			tokens = append(tokens, resolveToken(tokenBuffer, tokenSize, lineCount, columnCount))
-			tokens = append(tokens, terminalToToken(c, lineCount, columnCount))
-
-			clearBuffer(&tokenBuffer)
-			tokenSize = 0
-
-			// increment the line count and reset the column count
-			if c == '\n' {
-				lineCount++
-				columnCount = 0
-			}
-		} else {
-			// if we're not at a terminating charachter adding this charachter
-			// may mark the start of a comment
-			if tokenSize != 0 && tokenBuffer[tokenSize-1] == '/' && c == '/' {
-				tokenBuffer[tokenSize-1] = ' '
-
-				tokens = append(tokens, resolveToken(tokenBuffer, tokenSize, lineCount, columnCount))
-				tokens = append(tokens, Token{
-					TokenType: COMMENT,
-					line:      lineCount,
-					column:    columnCount,
-				})
+func tokeniseFileStream(stream bufio.Reader) ([]Token, Diagnostics) {
+	l := lexer{stream: &stream}
+	for {
+		c, ok := l.peek()
+		if !ok {
+			break
+		}
 
-				tokenSize = 0
-			} else {
-				// otherwise just append this charachter the buffer
-				tokenBuffer[tokenSize] = c
-				tokenSize++
+		switch {
+		case c == '\n' || (c == '\r' && l.peekNext() == '\n'):
+			l.emit(NEWLINE, nil, l.line, l.column)
+			if c == '\r' {
+				l.advance()
 			}
+			l.advance()
+		case isSpace(c):
+			l.advance()
+		case c == ',':
+			l.emit(COMMA, nil, l.line, l.column)
+			l.advance()
+		case l.atComment():
+			l.skipComment()
+		default:
+			l.lexWord()
 		}
-		columnCount++
 	}
+	return l.tokens, l.diagnostics
+}
 
-	// resolve the final token and return
-	return append(tokens, resolveToken(tokenBuffer, tokenSize, lineCount, columnCount))
+// peek returns the next byte without consuming it
+func (l *lexer) peek() (byte, bool) {
+	next, err := l.stream.Peek(1)
+	if err != nil {
+		return 0, false
+	}
+	return next[0], true
 }
 
-// converts a single terminal character to a token
-func terminalToToken(c byte, line, col int) Token {
-	switch c {
-	case ',':
-		return Token{
-			TokenType: COMMA,
-			line:      line,
-			column:    col,
-		}
-	case '\n':
-		return Token{
-			TokenType: NEWLINE,
-			line:      line,
-			column:    col,
+// peekNext returns the byte after the next byte without consuming either, 0 if there isn't one
+func (l *lexer) peekNext() byte {
+	next, err := l.stream.Peek(2)
+	if err != nil {
+		return 0
+	}
+	return next[1]
+}
+
+// advance consumes the next byte and keeps track of the position
+func (l *lexer) advance() byte {
+	c, err := l.stream.ReadByte()
+	if err != nil {
+		return 0
+	}
+	if c == '\n' {
+		l.line++
+		l.column = 0
+	} else {
+		l.column++
+	}
+	return c
+}
+
+// emit appends a token that started at the given position and ends at the current position
+func (l *lexer) emit(kind tokenType, value []byte, line, column int) {
+	if kind == NEWLINE || kind == COMMA {
+		l.tokens = append(l.tokens, Token{TokenType: kind, line: line, column: column, endColumn: column + 1})
+		return
+	}
+
+	kind, value = classifyToken(value)
+	l.tokens = append(l.tokens, Token{
+		TokenType: kind,
+		Value:     value,
+		line:      line,
+		column:    column,
+		endColumn: l.column,
+	})
+}
+
+// atComment determines if the stream is at the start of a comment
+func (l *lexer) atComment() bool {
+	c, ok := l.peek()
+	if !ok {
+		return false
+	}
+	return c == ';' || (c == '/' && (l.peekNext() == '/' || l.peekNext() == '*'))
+}
+
+// skipComment consumes a comment, line comments stop before the newline that ends them
+func (l *lexer) skipComment() {
+	line, column := l.line, l.column
+	if c := l.advance(); c == '/' && l.advance() == '*' {
+		for {
+			c, ok := l.peek()
+			if !ok {
+				l.diagnostics = append(l.diagnostics, Diagnostic{
+					Line:     line + 1,
+					Column:   column + 1,
+					Severity: SeverityError,
+					Message:  "Unterminated block comment",
+					Token:    "/*",
+				})
+				return
+			}
+			l.advance()
+			if next, ok := l.peek(); ok && c == '*' && next == '/' {
+				l.advance()
+				return
+			}
 		}
-	default:
-		return Token{
-			TokenType: VALUE,
-			Value:     nil,
-			line:      line,
-			column:    col,
+	}
+
+	for {
+		c, ok := l.peek()
+		if !ok || c == '\n' || (c == '\r' && l.peekNext() == '\n') {
+			return
 		}
+		l.advance()
 	}
 }
 
-// resolveToken converts the contents of a token buffer
-// into a singular token
-func resolveToken(buffer [100]byte, bufferSize, line, col int) Token {
-	if commentRegex.Match(buffer[:]) {
-		return Token{
-			TokenType: COMMENT,
+// lexWord consumes a single token, separators within string/char literals and parentheses
+// don't end the token
+func (l *lexer) lexWord() {
+	line, column := l.line, l.column
+	value := []byte{}
+
+	var quote byte = 0
+	escaped := false
+	depth := 0
+
+	for {
+		c, ok := l.peek()
+		if !ok || c == '\n' || (c == '\r' && l.peekNext() == '\n') {
+			break
+		}
+		if quote == 0 && (l.atComment() || (depth == 0 && (isSpace(c) || c == ','))) {
+			break
 		}
 
-	} else {
-		// Either the buffer is a value type or an instruction type
-		// this can be resolved rather easilly by searching in the instrucition table
-		// note that the conversion to a string results in an allocation on the heap which isnt
-		// ideal, TODO: change this i guess
-		value := make([]byte, bufferSize)
-		copy(value, buffer[:])
-		value = bytes.TrimSpace(value)
-		cleanedOpcode := strings.ToUpper(string(value))
-
-		if _, ok := OPCODES[cleanedOpcode]; ok {
-			return Token{
-				TokenType: INSTRUCTION,
-				Value:     []byte(cleanedOpcode),
-				line:      line,
-				column:    col,
-			}
+		if quote == 0 && c == generatedSeparator {
+			l.diagnostics = append(l.diagnostics, Diagnostic{
+				Line:     l.line + 1,
+				Column:   l.column + 1,
+				Severity: SeverityError,
+				Message:  `Unexpected "@", it is reserved for names generated by macros and the linker`,
+				Token:    "@",
+			})
 		}
 
-		return Token{
-			TokenType: VALUE,
-			Value:     value,
-			line:      line,
-			column:    col,
+		value = append(value, l.advance())
+		switch {
+		case quote == 0 && (c == '"' || c == '\''):
+			quote = c
+		case quote != 0 && c == quote && !escaped:
+			quote = 0
+		case quote == 0 && c == '(':
+			depth++
+		case quote == 0 && c == ')':
+			depth = max(depth-1, 0)
 		}
+		escaped = quote != 0 && c == '\\' && !escaped
 	}
+
+	l.emit(VALUE, value, line, column)
 }
 
-var commentRegex = regexp.MustCompile(`^\\\\\s*$`)
+// isSpace determines if a byte is whitespace other than a newline, a carriage return that
+// isn't part of a \r\n pair is treated as a space
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\v' || c == '\f' || c == '\r'
+}
+
+// classifyToken determines if a token's value is an instruction, a directive or a plain value
+// and returns the value in its canonical form
+func classifyToken(value []byte) (tokenType, []byte) {
+	cleanedOpcode := strings.ToUpper(string(value))
+	cleanedDirective := strings.ToLower(string(value))
+
+	if _, ok := lookupOpcode(cleanedOpcode); ok {
+		return INSTRUCTION, []byte(cleanedOpcode)
+	} else if _, ok := DIRECTIVES[cleanedDirective]; ok || PREPROCESSOR_DIRECTIVES[cleanedDirective] {
+		return DIRECTIVE, []byte(cleanedDirective)
+	}
+	return VALUE, value
+}
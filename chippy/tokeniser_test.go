@@ -0,0 +1,89 @@
+package chippy
+
+import (
+	"bufio"
+	"strings"
+	"testing"
+)
+
+// lexed is the part of a token the tokeniser tests check
+type lexed struct {
+	value             string
+	line, column, end int
+}
+
+func lex(t *testing.T, source string) []lexed {
+	t.Helper()
+	tokens, diagnostics := tokeniseFile("test.chippy", *bufio.NewReader(strings.NewReader(source)))
+	if diagnostics.HasErrors() {
+		t.Fatalf("failed to tokenise:\n%s", diagnostics)
+	}
+
+	result := []lexed{}
+	for _, token := range tokens {
+		result = append(result, lexed{string(token.Value), token.line, token.column, token.endColumn})
+	}
+	return result
+}
+
+func assertTokens(t *testing.T, source string, want []lexed) {
+	t.Helper()
+	got := lex(t, source)
+	if len(got) != len(want) {
+		t.Fatalf("got %d tokens %v, want %d tokens %v", len(got), got, len(want), want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("token %d is %+v, want %+v", i, got[i], want[i])
+		}
+	}
+}
+
+func TestTokenSpans(t *testing.T) {
+	assertTokens(t, "mov\t$r1,#+(1 + 2)\n  hlt", []lexed{
+		{"MOV", 0, 0, 3},
+		{"$r1", 0, 4, 7},
+		{"#+(1 + 2)", 0, 8, 17},
+		{"HLT", 1, 2, 5},
+	})
+}
+
+func TestCRLF(t *testing.T) {
+	assertTokens(t, "print $r1\r\nhlt\r\n", []lexed{
+		{"PRINT", 0, 0, 5},
+		{"$r1", 0, 6, 9},
+		{"HLT", 1, 0, 3},
+	})
+}
+
+func TestComments(t *testing.T) {
+	assertTokens(t, "; full line\nhlt // trailing\nhlt;x\n/* a\nblock */ hlt\n", []lexed{
+		{"HLT", 1, 0, 3},
+		{"HLT", 2, 0, 3},
+		{"HLT", 4, 9, 12},
+	})
+}
+
+func TestLiterals(t *testing.T) {
+	assertTokens(t, `.ascii "a, b ; // c", ','`, []lexed{
+		{".ascii", 0, 0, 6},
+		{`"a, b ; // c"`, 0, 7, 20},
+		{`','`, 0, 22, 25},
+	})
+}
+
+func TestLongTokens(t *testing.T) {
+	name := strings.Repeat("x", 500)
+	assertTokens(t, ".equ "+name+", 1", []lexed{
+		{".equ", 0, 0, 4},
+		{name, 0, 5, 505},
+		{"1", 0, 507, 508},
+	})
+}
+
+func TestUnterminatedBlockComment(t *testing.T) {
+	_, diagnostics := tokeniseFile("test.chippy", *bufio.NewReader(strings.NewReader("hlt\n  /* never closed")))
+	if len(diagnostics) != 1 || diagnostics[0].Line != 2 || diagnostics[0].Column != 3 {
+		t.Errorf("got %v, want a single error at 2:3", diagnostics)
+	}
+}
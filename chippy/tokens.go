@@ -13,7 +13,7 @@ const (
 	VALUE
 	COMMA
 	NEWLINE
-	COMMENT
+	DIRECTIVE
 )
 
 // General token type is a union of all the above types
@@ -21,8 +21,23 @@ type Token struct {
 	TokenType tokenType
 	Value     []byte
 
-	line   int
-	column int
+	// tokens never span lines, column is where the token starts and endColumn
+	// is just past its last character
+	file      string
+	line      int
+	column    int
+	endColumn int
+
+	// tokens produced by a macro expansion keep the position of the macro body they were
+	// copied from, expansion identifies the particular expansion and expandedFrom is the call site
+	expansion    int
+	expandedFrom *Token
+}
+
+// sameLine determines if two tokens were written on the same line, tokens from different
+// macro expansions are never on the same line even if they share a line in the macro body
+func sameLine(a, b Token) bool {
+	return a.file == b.file && a.line == b.line && a.expansion == b.expansion
 }
 
 // SyntaxNode is a node in our "abstract syntax linked list"
@@ -37,6 +52,9 @@ const (
 	PCRelativeValue       = 8
 	Label                 = 16
 	Addr                  = 32
+	Directive             = 64
+	StringValue           = 128
+	Identifier            = 256
 )
 
 type SyntaxNode struct {
@@ -50,8 +68,16 @@ type SyntaxNode struct {
 	// the children form an argument list
 	Children []SyntaxNode
 
-	line int
-	col  int
+	// position of the node in the source file along with the source text it was created
+	// from, a node spans [col, endCol) on its line
+	file   string
+	source string
+	line   int
+	col    int
+	endCol int
+
+	// expandedFrom is the macro call site the node was expanded from, if any
+	expandedFrom *Token
 }
 
 // cleanSyntaxNode takes a node and cleans the inner contents
@@ -59,33 +85,45 @@ type SyntaxNode struct {
 func cleanSyntaxNode(node SyntaxNode) SyntaxNode {
 	if node.NodeType == ImmediateValue {
 		node.Value = node.Value[1:]
-	} else if node.NodeType == Addr {
-		node.Value = node.Value[1 : len(node.Value)-1]
 	}
 	return node
 }
 
-// regular expressions for matching value types]
-var labelExpr = `\.\w+`
-var numericExpr = `#\d+`
+// regular expressions for matching value types], most values are expressions which
+// are validated and evaluated separately (see expressions.go)
+// generatedSeparator joins a name to the suffix macro expansion or linking adds to make it unique
+// (.loop@m1 or .loop@o2), it can't be written in source so generated names never clash with the programmer's
+const generatedSeparator = '@'
+
+var labelExpr = `\.[\w@]+`
 var integerRegister = `r(?:[1-9]|10|11|12|13)`
-var register = fmt.Sprintf(`(?:%s)|(?:sp|cmp|zero)`, integerRegister)
+var register = fmt.Sprintf(`(?:%s)|(?:sp|bp|zero)`, integerRegister)
 
 // For ease of parsing all these regular expressions return the matched value in the VALUE capturing group
 var labelRegex = regexp.MustCompile(fmt.Sprintf(`^(?P<Value>%s)$`, labelExpr))
-var addrRegex = regexp.MustCompile(`^\[(?P<Value>\d+)\]$`)
-var immediateRegex = regexp.MustCompile(fmt.Sprintf(`^(?P<Value>%s)$`, numericExpr))
+var addrRegex = regexp.MustCompile(`^\[(?P<Value>.+)\]$`)
+var immediateRegex = regexp.MustCompile(`^(?P<Value>#.+)$`)
 var registerRegex = regexp.MustCompile(fmt.Sprintf(`^\$(?P<Value>%s)$`, register))
-var registerRelativeRegex = regexp.MustCompile(fmt.Sprintf(`^(?P<Argument>\d+)\+(?P<Value>\$%s)$`, register))
-var pcRelativeRegex = regexp.MustCompile(`^#\((?P<Value>\d+)\)$`)
+var registerRelativeRegex = regexp.MustCompile(fmt.Sprintf(`^(?P<Argument>.+)\+\$(?P<Value>%s)$`, register))
+var pcRelativeRegex = regexp.MustCompile(`^#\((?P<Value>.+)\)$`)
+
+// a bare expression such as .loop or .table+8 is an address, it is
+// treated exactly like a label
+var addressExpressionRegex = regexp.MustCompile(`^(?P<Value>[^#$\[].*)$`)
+
+type valueType struct {
+	nodeType nodeType
+	regex    *regexp.Regexp
+}
 
 // Theres a few discrete values this could be
-// we just verify what it is against the regular expressions at the bottom
-var recognisedValueTypes = map[nodeType]*regexp.Regexp{
-	Label:                 labelRegex,
-	ImmediateValue:        immediateRegex,
-	Addr:                  addrRegex,
-	RegisterValue:         registerRegex,
-	RegisterRelativeValue: registerRelativeRegex,
-	PCRelativeValue:       pcRelativeRegex,
+// we just verify what it is against the regular expressions above, note that the order
+// matters as some of the expressions overlap (eg. #(1) is PC relative while #(1)+1 is immediate)
+var recognisedValueTypes = []valueType{
+	{RegisterValue, registerRegex},
+	{RegisterRelativeValue, registerRelativeRegex},
+	{Addr, addrRegex},
+	{PCRelativeValue, pcRelativeRegex},
+	{ImmediateValue, immediateRegex},
+	{Label, addressExpressionRegex},
 }
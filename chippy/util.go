@@ -2,12 +2,6 @@ package chippy
 
 import "regexp"
 
-func clearBuffer(buffer *[100]byte) {
-	for i := 0; i < 100; i++ {
-		buffer[i] = 0
-	}
-}
-
 func min(a, b int) int {
 	if a > b {
 		return b
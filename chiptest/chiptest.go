@@ -0,0 +1,212 @@
+// Package chiptest runs chippy programs on a headless Chipster so tests can make assertions
+// about the state the program leaves behind.
+//
+// A typical test assembles and runs a program and then checks the result:
+//
+//	result := chiptest.Run(t, `
+//		mov $r1, #2
+//		add $r1, #3
+//		print $r1
+//		hlt
+//	`)
+//	result.AssertRegister("r1", 5)
+//	result.AssertOutput("Outputted: 5\n")
+package chiptest
+
+import (
+	"bufio"
+	"bytes"
+	"cheepcheep/chippy"
+	"cheepcheep/emulator"
+	"cheepcheep/isa"
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+// DefaultSteps is the number of instructions a program may execute before it is stopped
+const DefaultSteps = 100000
+
+// Options controls how a program is run
+type Options struct {
+	// Steps is the most instructions the program may execute, DefaultSteps if it is 0
+	Steps int
+	// Input is read by the console device
+	Input string
+	// Seed seeds the random number device
+	Seed int64
+	// Protect maps the program as ROM so writing to it faults
+	Protect bool
+	// AllowRunning stops the program after Steps instructions without failing the test if it is
+	// still running, by default a program that doesn't halt fails the test
+	AllowRunning bool
+}
+
+// Result is the state a program finished in
+type Result struct {
+	t testing.TB
+
+	// Chip is the chip the program ran on
+	Chip *emulator.Chipster
+	// ROM is the assembled program
+	ROM []byte
+	// Output holds everything the program printed with PRINT and Console everything it wrote to the console device
+	Output  string
+	Console string
+	// Steps is the number of instructions the program executed, Chip.Cycles holds the clock cycles they took
+	Steps int
+}
+
+// Assemble assembles source into a ROM, failing the test if it doesn't assemble
+func Assemble(t testing.TB, source string) []byte {
+	t.Helper()
+	nodes, err := chippy.Parse("test.chippy", *bufio.NewReader(strings.NewReader(source)))
+	if err != nil {
+		t.Fatalf("failed to parse program:\n%s", err)
+	}
+	compiled, err := chippy.Compile(nodes)
+	if err != nil {
+		t.Fatalf("failed to compile program:\n%s", err)
+	}
+	rom, err := io.ReadAll(compiled)
+	if err != nil {
+		t.Fatalf("failed to read compiled program: %s", err)
+	}
+	return rom
+}
+
+// Run assembles source and runs it on a fresh chip with the standard devices attached until it halts
+func Run(t testing.TB, source string) *Result {
+	t.Helper()
+	return RunWithOptions(t, source, Options{})
+}
+
+// RunWithOptions is the same as Run but allows the way the program is run to be changed
+func RunWithOptions(t testing.TB, source string, options Options) *Result {
+	t.Helper()
+	rom := Assemble(t, source)
+	if options.Steps == 0 {
+		options.Steps = DefaultSteps
+	}
+
+	var output, console bytes.Buffer
+	chip := load(t, rom, options, &output, &console)
+	executed, _ := chip.Run(context.Background(), uint64(options.Steps))
+	if !chip.Halted && !options.AllowRunning {
+		t.Fatalf("program did not halt within %d instructions, pc is 0x%04x", options.Steps, chip.Pc)
+	}
+
+	return &Result{
+		t:       t,
+		Chip:    chip,
+		ROM:     rom,
+		Output:  output.String(),
+		Console: console.String(),
+		Steps:   int(executed),
+	}
+}
+
+// Load assembles source onto a fresh chip with the standard devices attached without running it, for tests
+// that drive the chip themselves, Steps and AllowRunning are ignored and anything the program prints is discarded
+func Load(t testing.TB, source string, options Options) *emulator.Chipster {
+	t.Helper()
+	return load(t, Assemble(t, source), options, io.Discard, io.Discard)
+}
+
+// load builds a chip for options with rom loaded at address 0, PRINT writes to output and the console to console
+func load(t testing.TB, rom []byte, options Options, output io.Writer, console io.Writer) *emulator.Chipster {
+	t.Helper()
+	romSize := 0
+	if options.Protect {
+		romSize = len(rom)
+	}
+
+	chip, err := emulator.NewChipWithDevices(romSize, emulator.NewDevices(strings.NewReader(options.Input), console, options.Seed))
+	if err != nil {
+		t.Fatalf("failed to attach devices: %s", err)
+	}
+	chip.Output = output
+	if err := chip.Bus.(*emulator.MemoryMap).Load(0, rom); err != nil {
+		t.Fatalf("failed to load program: %s", err)
+	}
+	return &chip
+}
+
+// AssertRegister checks the value of a register, the name is written as in assembly without the $
+func (r *Result) AssertRegister(name string, want uint16) {
+	r.t.Helper()
+	register, ok := isa.REGISTERS[name]
+	if !ok {
+		r.t.Fatalf("unknown register $%s", name)
+	}
+	if got := r.Chip.ReadRegister(register); got != want {
+		r.t.Errorf("$%s = %d (0x%04x), want %d (0x%04x)", name, got, got, want, want)
+	}
+}
+
+// AssertMemory checks the bytes of memory starting at address
+func (r *Result) AssertMemory(address uint16, want []byte) {
+	r.t.Helper()
+	got := make([]byte, len(want))
+	for i := range want {
+		value, err := r.Chip.Bus.Read(address + uint16(i))
+		if err != nil {
+			r.t.Fatalf("failed to read memory: %s", err)
+		}
+		got[i] = value
+	}
+	if !bytes.Equal(got, want) {
+		r.t.Errorf("memory at 0x%04x = % x, want % x", address, got, want)
+	}
+}
+
+// AssertFlags checks that the flags in set are set and the flags in clear are clear, every
+// other flag may have any value
+func (r *Result) AssertFlags(set uint16, clear uint16) {
+	r.t.Helper()
+	if r.Chip.Vf&set != set || r.Chip.Vf&clear != 0 {
+		r.t.Errorf("flags are %s, want 0b%016b set and 0b%016b clear", emulator.DescribeFlags(r.Chip.Vf), set, clear)
+	}
+}
+
+// AssertOutput checks everything the program printed with PRINT
+func (r *Result) AssertOutput(want string) {
+	r.t.Helper()
+	if r.Output != want {
+		r.t.Errorf("output = %q, want %q", r.Output, want)
+	}
+}
+
+// AssertConsole checks everything the program wrote to the console device
+func (r *Result) AssertConsole(want string) {
+	r.t.Helper()
+	if r.Console != want {
+		r.t.Errorf("console output = %q, want %q", r.Console, want)
+	}
+}
+
+// AssertPc checks the final value of the program counter
+func (r *Result) AssertPc(want uint16) {
+	r.t.Helper()
+	if r.Chip.Pc != want {
+		r.t.Errorf("pc = 0x%04x, want 0x%04x", r.Chip.Pc, want)
+	}
+}
+
+// AssertFault checks that the program faulted with target (as matched by errors.Is)
+func (r *Result) AssertFault(target error) {
+	r.t.Helper()
+	if !errors.Is(r.Chip.Fault, target) {
+		r.t.Errorf("fault = %v, want %v", r.Chip.Fault, target)
+	}
+}
+
+// AssertNoFault checks that the program didn't fault
+func (r *Result) AssertNoFault() {
+	r.t.Helper()
+	if r.Chip.Fault != nil {
+		r.t.Errorf("program faulted: %s", r.Chip.Fault)
+	}
+}
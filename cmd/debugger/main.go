@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bufio"
+	"cheepcheep/chippy"
+	"cheepcheep/debugger"
+	"cheepcheep/emulator"
+	"cheepcheep/symbols"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+)
+
+// Interactive step debugger for Chipster ROMs
+// usage: debugger [-symbols rom.dbg | -source rom.chippy] rom.chip
+
+func main() {
+	symbolFile := flag.String("symbols", "", "debug file written by the assembler, used to resolve labels and source lines")
+	sourceFile := flag.String("source", "", "the .chippy source of the ROM, used instead of -symbols")
+	inputFile := flag.String("input", "", "file the console device reads from, standard in is used by the debugger itself")
+	seed := flag.Int64("seed", 1, "seed for the random number device")
+	historyLimit := flag.Int("history", 10000, "number of instructions the debugger can step back through")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: %s [flags] rom.chip\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	// standard in belongs to the debugger's prompt so the console only has input if it's given a file
+	var input io.Reader
+	if *inputFile != "" {
+		f, err := os.Open(*inputFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error - could not open console input: %s\n", err)
+			os.Exit(1)
+		}
+		defer f.Close()
+		input = f
+	}
+
+	chip, err := emulator.NewChipWithDevices(0, emulator.NewDevices(input, os.Stdout, *seed))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error - could not attach devices: %s\n", err)
+		os.Exit(1)
+	}
+	if err := chip.LoadROM(flag.Arg(0)); err != nil {
+		fmt.Fprintf(os.Stderr, "Error - could not load ROM: %s\n", err)
+		os.Exit(1)
+	}
+
+	chip.EnableHistory(*historyLimit)
+
+	var table *symbols.Table
+	if *symbolFile != "" {
+		table, err = symbols.Load(*symbolFile)
+	} else if *sourceFile != "" {
+		table, err = symbolsFromSource(*sourceFile)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error - could not load debug information:\n%s\n", err)
+		os.Exit(1)
+	}
+
+	debugger.New(&chip, table, os.Stdout).Run(os.Stdin)
+}
+
+// symbolsFromSource parses the ROM's source file and computes its debug information
+func symbolsFromSource(sourceFile string) (*symbols.Table, error) {
+	f, err := os.Open(sourceFile)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	nodes, err := chippy.Parse(sourceFile, *bufio.NewReader(f))
+	if err != nil {
+		return nil, err
+	}
+	return chippy.DebugInfo(nodes)
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"cheepcheep/disassembler"
+	"cheepcheep/symbols"
+	"flag"
+	"fmt"
+	"os"
+)
+
+// Turns a compiled ROM back into .chippy source
+// usage: disassembler [-symbols rom.dbg] [-o rom.chippy] rom.chip
+
+func main() {
+	symbolFile := flag.String("symbols", "", "debug file written by the assembler, its labels are used instead of synthesized ones")
+	outputFile := flag.String("o", "", "file to write the disassembly to, defaults to standard out")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: %s [flags] rom.chip\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	rom, err := os.ReadFile(flag.Arg(0))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error - could not load ROM: %s\n", err)
+		os.Exit(1)
+	}
+
+	var table *symbols.Table
+	if *symbolFile != "" {
+		if table, err = symbols.Load(*symbolFile); err != nil {
+			fmt.Fprintf(os.Stderr, "Error - could not load symbols: %s\n", err)
+			os.Exit(1)
+		}
+	}
+
+	output := os.Stdout
+	if *outputFile != "" {
+		if output, err = os.Create(*outputFile); err != nil {
+			fmt.Fprintf(os.Stderr, "Error - could not create output file: %s\n", err)
+			os.Exit(1)
+		}
+		defer output.Close()
+	}
+
+	if err := disassembler.Disassemble(rom, table, output); err != nil {
+		fmt.Fprintf(os.Stderr, "Error - could not write disassembly: %s\n", err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"cheepcheep/emulator"
+	"cheepcheep/isa"
+	"cheepcheep/symbols"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// Runs a compiled ROM on the Chipster emulator until it halts
+// usage: emulator [flags] rom.chip
+//        emulator [flags] -resume state.snap
+
+func main() {
+	stepLimit := flag.Uint64("steps", 0, "maximum number of instructions to execute, 0 means no limit")
+	cycleLimit := flag.Uint64("cycles", 0, "stop once the chip has taken this many clock cycles in total, 0 means no limit")
+	clockSpeed := flag.Uint64("hz", 0, "clock speed in cycles per second, 0 means run as fast as possible")
+	dump := flag.Bool("dump", false, "dump the registers and flags once the emulator stops")
+	symbolFile := flag.String("symbols", "", "debug file written by the assembler, used to describe the final program counter")
+	protect := flag.Bool("protect", false, "map the ROM as read only memory, writing to it becomes a fault")
+	inputFile := flag.String("input", "", "file the console device reads from, defaults to standard in")
+	traceFile := flag.String("trace", "", "record every step the chip takes to this file as JSON lines, see the trace tool")
+	seed := flag.Int64("seed", 0, "seed for the random number device, 0 picks one based on the current time")
+	resumeFile := flag.String("resume", "", "resume the run saved in a snapshot instead of loading a ROM")
+	saveFile := flag.String("save", "", "save a snapshot of the chip to this file when it stops or is interrupted (SIGINT or SIGTERM)")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: %s [flags] rom.chip\n", os.Args[0])
+		fmt.Fprintf(flag.CommandLine.Output(), "       %s [flags] -resume state.snap\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if (*resumeFile == "" && flag.NArg() != 1) || (*resumeFile != "" && flag.NArg() != 0) {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	// a resumed chip's memory layout comes from the snapshot
+	romSize := 0
+	if *protect && *resumeFile == "" {
+		info, err := os.Stat(flag.Arg(0))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error - could not load ROM: %s\n", err)
+			os.Exit(1)
+		}
+		romSize = int(info.Size())
+	}
+
+	if *seed == 0 {
+		*seed = time.Now().UnixNano()
+	}
+
+	// standard in is typed in as the program runs so it is read without blocking the chip,
+	// an input file is read as needed so runs with it can be reproduced
+	devices := emulator.NewDevices(nil, os.Stdout, *seed)
+	if *inputFile != "" {
+		input, err := os.Open(*inputFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error - could not open console input: %s\n", err)
+			os.Exit(1)
+		}
+		defer input.Close()
+		devices.Console = emulator.NewConsole(input, os.Stdout)
+	} else {
+		devices.Console = emulator.NewInteractiveConsole(os.Stdin, os.Stdout)
+	}
+	devices.Console.Interrupts = devices.Interrupts
+
+	chip, err := emulator.NewChipWithDevices(romSize, devices)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error - could not attach devices: %s\n", err)
+		os.Exit(1)
+	}
+	if *resumeFile != "" {
+		if err := restore(&chip, *resumeFile); err != nil {
+			fmt.Fprintf(os.Stderr, "Error - could not resume snapshot: %s\n", err)
+			os.Exit(1)
+		}
+	} else if err := chip.LoadROM(flag.Arg(0)); err != nil {
+		fmt.Fprintf(os.Stderr, "Error - could not load ROM: %s\n", err)
+		os.Exit(1)
+	}
+
+	var table *symbols.Table
+	if *symbolFile != "" {
+		if table, err = symbols.Load(*symbolFile); err != nil {
+			fmt.Fprintf(os.Stderr, "Error - could not load symbols: %s\n", err)
+			os.Exit(1)
+		}
+	}
+
+	var tracer *emulator.TraceWriter
+	if *traceFile != "" {
+		f, err := os.Create(*traceFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error - could not create trace: %s\n", err)
+			os.Exit(1)
+		}
+		defer f.Close()
+		tracer = emulator.NewTraceWriter(f)
+		chip.Tracer = tracer
+	}
+
+	// throttle execution if a clock speed was requested
+	chip.ClockSpeed = *clockSpeed
+	chip.CycleLimit = *cycleLimit
+
+	// with somewhere to save the chip to, being interrupted stops the run instead of killing the emulator
+	ctx := context.Background()
+	if *saveFile != "" {
+		var stop context.CancelFunc
+		ctx, stop = signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+		defer stop()
+	}
+
+	executed, err := chip.Run(ctx, *stepLimit)
+	if tracer != nil {
+		if err := tracer.Flush(); err != nil {
+			fmt.Fprintf(os.Stderr, "Error - could not write trace: %s\n", err)
+		}
+	}
+
+	if *saveFile != "" {
+		if err := save(&chip, *saveFile); err != nil {
+			fmt.Fprintf(os.Stderr, "Error - could not save snapshot: %s\n", err)
+		}
+	}
+
+	var fault *emulator.Fault
+	if errors.As(err, &fault) {
+		fmt.Fprintf(os.Stderr, "Fault - %s (%s) at %s\n", fault.Err, fault.Kind, table.Describe(fault.Pc))
+	} else if err != nil {
+		fmt.Fprintf(os.Stderr, "Stopped - interrupted at %s\n", table.Describe(chip.Pc))
+	} else if !chip.Halted && *stepLimit != 0 && executed >= *stepLimit {
+		fmt.Fprintf(os.Stderr, "Stopped - step limit of %d instructions reached without halting at %s\n", *stepLimit, table.Describe(chip.Pc))
+	} else if !chip.Halted {
+		fmt.Fprintf(os.Stderr, "Stopped - cycle limit of %d cycles reached without halting at %s (%d cycles taken)\n",
+			*cycleLimit, table.Describe(chip.Pc), chip.Cycles)
+	}
+	if *dump {
+		dumpState(&chip, table, executed)
+	}
+	if !chip.Halted || chip.Fault != nil {
+		os.Exit(1)
+	}
+}
+
+// restore loads a snapshot written by save into the chip
+func restore(chip *emulator.Chipster, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return chip.Restore(f)
+}
+
+// save writes a snapshot of the chip to path
+func save(chip *emulator.Chipster, path string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := chip.Snapshot(f); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// dumpState prints the registers, program counter and flags of the chip
+func dumpState(chip *emulator.Chipster, table *symbols.Table, executed uint64) {
+	fmt.Printf("Executed %d instructions in %d cycles\n", executed, chip.Cycles)
+	fmt.Printf("PC: 0x%04x %s  VF: %s\n", chip.Pc, table.Describe(chip.Pc), emulator.DescribeFlags(chip.Vf))
+
+	for i := uint8(1); i < isa.SP; i++ {
+		fmt.Printf("$%-4s = %5d", isa.RegisterName(i), chip.Registers[i])
+		if i%4 == 0 {
+			fmt.Println()
+		} else {
+			fmt.Print("   ")
+		}
+	}
+	fmt.Println()
+	fmt.Printf("$sp   = 0x%04x   $bp   = 0x%04x\n", chip.StackRegisters[0], chip.StackRegisters[1])
+	fmt.Printf("IE: %t", chip.InterruptsEnabled)
+	if chip.Interrupts != nil {
+		fmt.Printf("  enabled: %08b  pending: %08b", chip.Interrupts.Enabled, chip.Interrupts.Pending)
+	}
+	fmt.Println()
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bufio"
+	"cheepcheep/chippy"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+)
+
+// Combines relocatable objects produced by `chippy.out -c` into a single ROM
+// usage: linker [-debug rom.dbg] -o rom.chip main.obj lib.obj ...
+
+func main() {
+	outputFile := flag.String("o", "", "file to write the linked ROM to")
+	debugFile := flag.String("debug", "", "also write a symbol and source map file to this path")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: %s [flags] -o rom.chip object.obj ...\n", os.Args[0])
+		fmt.Fprintln(flag.CommandLine.Output(), "objects are placed in the order given, the first starts at address 0")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() == 0 || *outputFile == "" {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	objects := []*chippy.Object{}
+	for _, path := range flag.Args() {
+		object, err := chippy.LoadObject(path)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error - could not load object %s: %s\n", path, err)
+			os.Exit(1)
+		}
+		objects = append(objects, object)
+	}
+
+	nodes, err := chippy.Link(objects)
+	if err != nil {
+		reportErrors(err)
+	}
+	compiledStream, err := chippy.Compile(nodes)
+	if err != nil {
+		reportErrors(err)
+	}
+
+	o, err := os.Create(*outputFile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error - could not create output file: %s\n", err)
+		os.Exit(1)
+	}
+	defer o.Close()
+
+	w := bufio.NewWriter(o)
+	if _, err := compiledStream.WriteTo(w); err != nil {
+		fmt.Fprintf(os.Stderr, "Error - could not write ROM: %s\n", err)
+		os.Exit(1)
+	}
+	w.Flush()
+
+	if *debugFile != "" {
+		writeDebugInfo(nodes, *debugFile)
+	}
+}
+
+// writeDebugInfo writes the symbol table and source map of the linked program out to a file
+func writeDebugInfo(nodes []chippy.SyntaxNode, debugFile string) {
+	table, err := chippy.DebugInfo(nodes)
+	if err != nil {
+		reportErrors(err)
+	}
+
+	d, err := os.Create(debugFile)
+	if err == nil {
+		err = table.Write(d)
+		d.Close()
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error - could not write debug file: %s\n", err)
+		os.Exit(1)
+	}
+}
+
+// reportErrors prints the diagnostics in err along with excerpts of the offending source and then exits
+func reportErrors(err error) {
+	var diagnostics chippy.Diagnostics
+	if !errors.As(err, &diagnostics) {
+		fmt.Fprintf(os.Stderr, "Error - %s\n", err)
+		os.Exit(1)
+	}
+
+	diagnostics.Report(os.Stderr)
+	fmt.Fprintf(os.Stderr, "%d error(s), linking failed\n", len(diagnostics))
+	os.Exit(1)
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"cheepcheep/emulator"
+	"cheepcheep/isa"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// Inspects traces recorded with `emulator -trace`
+// usage: trace show [flags] run.trace
+//        trace diff a.trace b.trace
+//        trace replay [flags] rom.chip run.trace
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: %s show [flags] run.trace\n", os.Args[0])
+		fmt.Fprintf(flag.CommandLine.Output(), "       %s diff a.trace b.trace\n", os.Args[0])
+		fmt.Fprintf(flag.CommandLine.Output(), "       %s replay [flags] rom.chip run.trace\n", os.Args[0])
+		fmt.Fprintln(flag.CommandLine.Output(), "run a command with -h to see its flags")
+	}
+	if len(os.Args) < 2 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	switch os.Args[1] {
+	case "show":
+		show(os.Args[2:])
+	case "diff":
+		diff(os.Args[2:])
+	case "replay":
+		replay(os.Args[2:])
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+}
+
+// show prints the steps of a trace that match every given filter
+func show(args []string) {
+	flags := flag.NewFlagSet("show", flag.ExitOnError)
+	from := flags.Uint64("from", 0, "first step to show")
+	to := flags.Int64("to", -1, "last step to show, -1 shows every step to the end of the trace")
+	pc := flags.String("pc", "", "only show steps executed at this address")
+	op := flags.String("op", "", "only show steps executing this instruction (eg. add)")
+	writes := flags.String("writes", "", "only show steps that wrote to this register (eg. $r1) or address")
+	asJSON := flags.Bool("json", false, "print the matching steps as JSON lines so they can be read back as a trace")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	filters := []func(emulator.TraceStep) bool{
+		func(step emulator.TraceStep) bool { return step.Step >= *from && (*to < 0 || step.Step <= uint64(*to)) },
+	}
+	if *pc != "" {
+		address := parseAddress(*pc)
+		filters = append(filters, func(step emulator.TraceStep) bool { return step.Pc == address })
+	}
+	if *op != "" {
+		filters = append(filters, func(step emulator.TraceStep) bool {
+			mnemonic, _, _ := strings.Cut(step.Instruction, " ")
+			return strings.EqualFold(mnemonic, *op)
+		})
+	}
+	if *writes != "" {
+		filters = append(filters, writesFilter(*writes))
+	}
+
+	encoder := json.NewEncoder(os.Stdout)
+	for _, step := range readTrace(flags.Arg(0)) {
+		if !matchesAll(step, filters) {
+			continue
+		}
+		if *asJSON {
+			encoder.Encode(step)
+		} else {
+			fmt.Println(describe(step))
+		}
+	}
+}
+
+// writesFilter matches steps that write to a register (written $name) or a memory address
+func writesFilter(target string) func(emulator.TraceStep) bool {
+	if strings.HasPrefix(target, "$") {
+		register, ok := isa.REGISTERS[target[1:]]
+		if !ok {
+			fmt.Fprintf(os.Stderr, "Error - unknown register %s\n", target)
+			os.Exit(2)
+		}
+		return func(step emulator.TraceStep) bool {
+			for _, write := range step.Registers {
+				if write.Register == register {
+					return true
+				}
+			}
+			return false
+		}
+	}
+
+	address := parseAddress(target)
+	return func(step emulator.TraceStep) bool {
+		for _, write := range step.Memory {
+			if write.Address == address {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+func matchesAll(step emulator.TraceStep, filters []func(emulator.TraceStep) bool) bool {
+	for _, filter := range filters {
+		if !filter(step) {
+			return false
+		}
+	}
+	return true
+}
+
+// diff reports the first step at which two traces differ
+func diff(args []string) {
+	flags := flag.NewFlagSet("diff", flag.ExitOnError)
+	flags.Parse(args)
+	if flags.NArg() != 2 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	a, b := readTrace(flags.Arg(0)), readTrace(flags.Arg(1))
+	for i := 0; i < len(a) && i < len(b); i++ {
+		if !reflect.DeepEqual(a[i], b[i]) {
+			fmt.Printf("traces differ at step %d\n", a[i].Step)
+			fmt.Printf("< %s\n> %s\n", describe(a[i]), describe(b[i]))
+			os.Exit(1)
+		}
+	}
+
+	if len(a) != len(b) {
+		fmt.Printf("traces are the same for %d steps but %s has %d steps and %s has %d\n",
+			min(len(a), len(b)), flags.Arg(0), len(a), flags.Arg(1), len(b))
+		os.Exit(1)
+	}
+	fmt.Printf("traces are the same (%d steps)\n", len(a))
+}
+
+// replay rebuilds the state of the chip after a step by applying the trace to the ROM it was recorded from
+func replay(args []string) {
+	flags := flag.NewFlagSet("replay", flag.ExitOnError)
+	stepLimit := flags.Int64("step", -1, "step to reconstruct the state after, -1 replays the whole trace")
+	memory := flags.String("memory", "", "also print memory, written start:length (eg. 0x100:16)")
+	flags.Parse(args)
+	if flags.NArg() != 2 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	// the chip has the same memory map as the emulator's, the devices have no input and a fixed seed
+	// but are never run, writes to them are skipped when the trace is applied
+	chip, err := emulator.NewChipWithDevices(0, emulator.NewDevices(nil, nil, 1))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error - could not attach devices: %s\n", err)
+		os.Exit(1)
+	}
+	if err := chip.LoadROM(flags.Arg(0)); err != nil {
+		fmt.Fprintf(os.Stderr, "Error - could not load ROM: %s\n", err)
+		os.Exit(1)
+	}
+
+	replayed := 0
+	for _, step := range readTrace(flags.Arg(1)) {
+		if *stepLimit >= 0 && step.Step > uint64(*stepLimit) {
+			break
+		}
+		if err := step.Apply(&chip); err != nil {
+			fmt.Fprintf(os.Stderr, "Error - could not replay trace: %s\n", err)
+			os.Exit(1)
+		}
+		replayed++
+	}
+
+	fmt.Printf("Replayed %d steps\n", replayed)
+	fmt.Printf("PC: 0x%04x  VF: %s  IE: %t  halted: %t  cycles: %d\n", chip.Pc, emulator.DescribeFlags(chip.Vf), chip.InterruptsEnabled, chip.Halted, chip.Cycles)
+	for i := uint8(1); i <= isa.BP; i++ {
+		fmt.Printf("$%-4s = %5d", isa.RegisterName(i), chip.ReadRegister(i))
+		if i%4 == 0 || i == isa.BP {
+			fmt.Println()
+		} else {
+			fmt.Print("   ")
+		}
+	}
+
+	if *memory != "" {
+		start, length, _ := strings.Cut(*memory, ":")
+		address, count := parseAddress(start), parseAddress(length)
+		for i := uint16(0); i < count; i++ {
+			if i%16 == 0 {
+				fmt.Printf("\n0x%04x:", address+i)
+			}
+			// devices aren't read, they weren't replayed and reading them has side effects
+			if value, ok := chip.Peek(address + i); ok {
+				fmt.Printf(" %02x", value)
+			} else {
+				fmt.Print(" --")
+			}
+		}
+		fmt.Println()
+	}
+}
+
+// describe formats a step on a single line
+func describe(step emulator.TraceStep) string {
+	var line strings.Builder
+	fmt.Fprintf(&line, "#%-6d 0x%04x  ", step.Step, step.Pc)
+	if step.Interrupt != nil {
+		fmt.Fprintf(&line, "%-24s", fmt.Sprintf("<interrupt %d>", *step.Interrupt))
+	} else {
+		fmt.Fprintf(&line, "%-24s", step.Instruction)
+	}
+
+	for _, write := range step.Registers {
+		fmt.Fprintf(&line, " $%s=%d", isa.RegisterName(write.Register), write.Value)
+	}
+	for _, write := range step.Memory {
+		fmt.Fprintf(&line, " [0x%04x]=%d", write.Address, write.Value)
+	}
+	fmt.Fprintf(&line, " vf=0b%05b", step.Vf)
+	if step.Fault != "" {
+		fmt.Fprintf(&line, " fault: %s", step.Fault)
+	} else if step.Halted {
+		line.WriteString(" halted")
+	}
+	return line.String()
+}
+
+func readTrace(path string) []emulator.TraceStep {
+	f, err := os.Open(path)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error - could not open trace: %s\n", err)
+		os.Exit(1)
+	}
+	defer f.Close()
+
+	steps, err := emulator.ReadTrace(f)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error - could not read trace %s: %s\n", path, err)
+		os.Exit(1)
+	}
+	return steps
+}
+
+// parseAddress parses a 16 bit number written in decimal or with a 0x, 0b or 0o prefix
+func parseAddress(value string) uint16 {
+	parsed, err := strconv.ParseUint(value, 0, 16)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error - invalid address %s\n", value)
+		os.Exit(2)
+	}
+	return uint16(parsed)
+}
+
+func min(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
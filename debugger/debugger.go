@@ -0,0 +1,457 @@
+package debugger
+
+import (
+	"bufio"
+	"cheepcheep/emulator"
+	"cheepcheep/isa"
+	"cheepcheep/symbols"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Debugger wraps a Chipster and lets us step through a program, stopping
+// at breakpoints and whenever a watched register or memory location changes
+type Debugger struct {
+	Chip *emulator.Chipster
+
+	// Symbols holds the labels and source map of the ROM, it may be empty if
+	// we don't have any debug information for the ROM
+	Symbols *symbols.Table
+
+	breakpoints map[uint16]bool
+	watchpoints []watchpoint
+	out         io.Writer
+}
+
+type watchKind int
+
+const (
+	watchRegister watchKind = iota
+	watchMemory
+)
+
+// a watchpoint remembers the last value of whatever it watches so we
+// can detect when it changes
+type watchpoint struct {
+	kind   watchKind
+	target uint16
+	last   uint16
+}
+
+// New builds a debugger around a chip, the debugger writes all its output to out
+func New(chip *emulator.Chipster, table *symbols.Table, out io.Writer) *Debugger {
+	if table == nil {
+		table = symbols.NewTable()
+	}
+	return &Debugger{
+		Chip:        chip,
+		Symbols:     table,
+		breakpoints: map[uint16]bool{},
+		out:         out,
+	}
+}
+
+// Run starts the REPL, reading commands from in until EOF or a quit command
+func (d *Debugger) Run(in io.Reader) {
+	scanner := bufio.NewScanner(in)
+	d.printState()
+	for {
+		fmt.Fprint(d.out, "(cheep) ")
+		if !scanner.Scan() {
+			fmt.Fprintln(d.out)
+			return
+		}
+		if quit := d.Execute(scanner.Text()); quit {
+			return
+		}
+	}
+}
+
+// Execute runs a single debugger command, it returns true if the debugger should exit
+func (d *Debugger) Execute(command string) bool {
+	args := strings.Fields(command)
+	if len(args) == 0 {
+		return false
+	}
+
+	switch args[0] {
+	case "step", "s":
+		count := 1
+		if len(args) > 1 {
+			n, err := strconv.Atoi(args[1])
+			if err != nil || n < 1 {
+				fmt.Fprintf(d.out, "invalid step count %q\n", args[1])
+				return false
+			}
+			count = n
+		}
+		for i := 0; i < count; i++ {
+			if reason := d.Step(); reason != "" {
+				fmt.Fprintln(d.out, reason)
+				break
+			}
+		}
+		d.printState()
+
+	case "continue", "c":
+		fmt.Fprintln(d.out, d.Continue())
+		d.printState()
+
+	case "back", "bk":
+		count := 1
+		if len(args) > 1 {
+			n, err := strconv.Atoi(args[1])
+			if err != nil || n < 1 {
+				fmt.Fprintf(d.out, "invalid step count %q\n", args[1])
+				return false
+			}
+			count = n
+		}
+		if undone := d.StepBack(count); undone < count {
+			fmt.Fprintf(d.out, "stepped back %d instruction(s), no further history\n", undone)
+		}
+		d.printState()
+
+	case "last":
+		if len(args) != 2 {
+			fmt.Fprintln(d.out, "usage: last <$register|address|.label>")
+			return false
+		}
+		point, err := d.parseWatchpoint(args[1])
+		if err != nil {
+			fmt.Fprintln(d.out, err)
+			return false
+		}
+		if !d.reverseToWrite(point) {
+			fmt.Fprintf(d.out, "no write to %s in the history\n", d.describeWatchpoint(point))
+			return false
+		}
+		fmt.Fprintf(d.out, "%s was last written by\n", d.describeWatchpoint(point))
+		d.printState()
+
+	case "break", "b", "delete", "d":
+		if len(args) != 2 {
+			fmt.Fprintf(d.out, "usage: %s <address|.label>\n", args[0])
+			return false
+		}
+		address, err := d.resolveAddress(args[1])
+		if err != nil {
+			fmt.Fprintln(d.out, err)
+			return false
+		}
+		if args[0] == "break" || args[0] == "b" {
+			d.breakpoints[address] = true
+			fmt.Fprintf(d.out, "breakpoint set at %s\n", d.describeAddress(address))
+		} else {
+			delete(d.breakpoints, address)
+			fmt.Fprintf(d.out, "breakpoint removed from %s\n", d.describeAddress(address))
+		}
+
+	case "watch", "w":
+		if len(args) != 2 {
+			fmt.Fprintln(d.out, "usage: watch <$register|address|.label>")
+			return false
+		}
+		point, err := d.parseWatchpoint(args[1])
+		if err != nil {
+			fmt.Fprintln(d.out, err)
+			return false
+		}
+		d.watchpoints = append(d.watchpoints, point)
+		fmt.Fprintf(d.out, "watching %s\n", d.describeWatchpoint(point))
+
+	case "unwatch":
+		if len(args) != 2 {
+			fmt.Fprintln(d.out, "usage: unwatch <$register|address|.label>")
+			return false
+		}
+		point, err := d.parseWatchpoint(args[1])
+		if err != nil {
+			fmt.Fprintln(d.out, err)
+			return false
+		}
+		remaining := []watchpoint{}
+		for _, existing := range d.watchpoints {
+			if existing.kind != point.kind || existing.target != point.target {
+				remaining = append(remaining, existing)
+			}
+		}
+		d.watchpoints = remaining
+
+	case "info", "i":
+		d.printBreakpoints()
+
+	case "regs", "r":
+		d.printState()
+
+	case "mem", "m":
+		d.printMemory(args[1:])
+
+	case "help", "h":
+		fmt.Fprint(d.out, helpText)
+
+	case "quit", "q":
+		return true
+
+	default:
+		fmt.Fprintf(d.out, "unknown command %q, try help\n", args[0])
+	}
+	return false
+}
+
+// Step executes a single instruction, it returns a non empty reason if execution should stop
+// because the chip halted or a watchpoint fired
+func (d *Debugger) Step() string {
+	if d.Chip.Halted {
+		return "chip has halted"
+	}
+
+	var fault *emulator.Fault
+	if err := d.Chip.PerformNextComputation(); errors.As(err, &fault) {
+		if fault.Kind == emulator.FaultHalt {
+			return fmt.Sprintf("chip halted at %s", d.describeAddress(fault.Pc))
+		}
+		return fmt.Sprintf("chip faulted: %s (%s) at %s", fault.Err, fault.Kind, d.describeAddress(fault.Pc))
+	}
+
+	reasons := []string{}
+	for i := range d.watchpoints {
+		point := &d.watchpoints[i]
+		if current := d.watchedValue(*point); current != point.last {
+			reasons = append(reasons, fmt.Sprintf("watchpoint %s changed: %d -> %d", d.describeWatchpoint(*point), point.last, current))
+			point.last = current
+		}
+	}
+	return strings.Join(reasons, "\n")
+}
+
+// Continue executes instructions until a breakpoint or watchpoint is hit, or the chip halts
+func (d *Debugger) Continue() string {
+	for {
+		if reason := d.Step(); reason != "" {
+			return reason
+		}
+		if d.breakpoints[d.Chip.Pc] {
+			return fmt.Sprintf("breakpoint hit at %s", d.describeAddress(d.Chip.Pc))
+		}
+	}
+}
+
+// StepBack undoes up to n instructions, it returns the number undone which is less than n once
+// the chip's history runs out
+func (d *Debugger) StepBack(n int) int {
+	undone := d.Chip.StepBack(n)
+	d.refreshWatchpoints()
+	return undone
+}
+
+// reverseToWrite rewinds the chip to the most recent instruction that wrote to whatever a watchpoint
+// watches, the chip is left on that instruction, it returns false if no remembered instruction wrote to it
+func (d *Debugger) reverseToWrite(point watchpoint) bool {
+	var found bool
+	if point.kind == watchRegister {
+		found = d.Chip.ReverseToRegisterWrite(uint8(point.target))
+	} else {
+		found = d.Chip.ReverseToMemoryWrite(point.target)
+	}
+	d.refreshWatchpoints()
+	return found
+}
+
+// refreshWatchpoints makes the watchpoints remember the current values after the chip steps back,
+// otherwise the next step would report the values restored by stepping back as changes
+func (d *Debugger) refreshWatchpoints() {
+	for i := range d.watchpoints {
+		d.watchpoints[i].last = d.watchedValue(d.watchpoints[i])
+	}
+}
+
+// resolveAddress converts either a label or a numeric literal (decimal or 0x prefixed) into an address
+func (d *Debugger) resolveAddress(value string) (uint16, error) {
+	if strings.HasPrefix(value, ".") {
+		address, ok := d.Symbols.Labels[value]
+		if !ok {
+			return 0, fmt.Errorf("unknown label %q", value)
+		}
+		return address, nil
+	}
+
+	address, err := strconv.ParseUint(value, 0, 16)
+	if err != nil {
+		return 0, fmt.Errorf("invalid address %q", value)
+	}
+	return uint16(address), nil
+}
+
+func (d *Debugger) parseWatchpoint(value string) (watchpoint, error) {
+	point := watchpoint{}
+	if strings.HasPrefix(value, "$") {
+		register, ok := isa.REGISTERS[value[1:]]
+		if !ok {
+			return point, fmt.Errorf("unknown register %q", value)
+		}
+		point.kind, point.target = watchRegister, uint16(register)
+	} else {
+		address, err := d.resolveAddress(value)
+		if err != nil {
+			return point, err
+		}
+		if _, err := d.peek(address); err != nil {
+			return point, err
+		}
+		point.kind, point.target = watchMemory, address
+	}
+
+	point.last = d.watchedValue(point)
+	return point, nil
+}
+
+func (d *Debugger) watchedValue(point watchpoint) uint16 {
+	if point.kind == watchRegister {
+		return d.Chip.ReadRegister(uint8(point.target))
+	}
+	value, _ := d.peek(point.target)
+	return uint16(value)
+}
+
+func (d *Debugger) describeWatchpoint(point watchpoint) string {
+	if point.kind == watchRegister {
+		return "$" + isa.RegisterName(uint8(point.target))
+	}
+	return "memory " + d.describeAddress(point.target)
+}
+
+// describeAddress formats an address along with its label and source line, if they are known
+func (d *Debugger) describeAddress(address uint16) string {
+	description := d.Symbols.Describe(address)
+	if strings.HasPrefix(description, "0x") {
+		return description
+	}
+	return fmt.Sprintf("0x%04x %s", address, description)
+}
+
+// printState prints the registers, stack registers, program counter, flags and the next instruction
+func (d *Debugger) printState() {
+	chip := d.Chip
+	for i := uint8(1); i < isa.SP; i++ {
+		fmt.Fprintf(d.out, "$%-4s %5d  ", isa.RegisterName(i), chip.ReadRegister(i))
+		if i%7 == 0 {
+			fmt.Fprintln(d.out)
+		}
+	}
+	fmt.Fprintln(d.out)
+	fmt.Fprintf(d.out, "$sp 0x%04x  $bp 0x%04x  vf %s  ie %t  cycles %d\n", chip.StackRegisters[0], chip.StackRegisters[1], emulator.DescribeFlags(chip.Vf), chip.InterruptsEnabled, chip.Cycles)
+
+	var encoded [isa.InstructionSize]byte
+	bytes, err := d.readMemory(chip.Pc, isa.InstructionSize)
+	copy(encoded[:], bytes)
+	next := fmt.Sprintf("unreadable instruction (%s)", err)
+	if err == nil {
+		instruction, err := isa.Decode(encoded)
+		next = instruction.String()
+		if err != nil {
+			next = fmt.Sprintf("invalid instruction % x", encoded)
+		}
+	}
+	fmt.Fprintf(d.out, "pc  %s: %s\n", d.describeAddress(chip.Pc), next)
+}
+
+func (d *Debugger) printBreakpoints() {
+	addresses := []int{}
+	for address := range d.breakpoints {
+		addresses = append(addresses, int(address))
+	}
+	sort.Ints(addresses)
+
+	fmt.Fprintln(d.out, "breakpoints:")
+	for _, address := range addresses {
+		fmt.Fprintf(d.out, "  %s\n", d.describeAddress(uint16(address)))
+	}
+	fmt.Fprintln(d.out, "watchpoints:")
+	for _, point := range d.watchpoints {
+		fmt.Fprintf(d.out, "  %s = %d\n", d.describeWatchpoint(point), point.last)
+	}
+}
+
+// printMemory dumps a range of memory, usage: mem <address> [length]
+func (d *Debugger) printMemory(args []string) {
+	if len(args) == 0 {
+		fmt.Fprintln(d.out, "usage: mem <address|.label> [length]")
+		return
+	}
+	start, err := d.resolveAddress(args[0])
+	if err != nil {
+		fmt.Fprintln(d.out, err)
+		return
+	}
+	length := 16
+	if len(args) > 1 {
+		if length, err = strconv.Atoi(args[1]); err != nil || length < 1 {
+			fmt.Fprintf(d.out, "invalid length %q\n", args[1])
+			return
+		}
+	}
+
+	end := min(int(start)+length, 0x10000)
+	for row := int(start); row < end; row += 8 {
+		values := []string{}
+		for address := row; address < min(row+8, end); address++ {
+			value, err := d.peek(uint16(address))
+			if err != nil {
+				values = append(values, "--")
+			} else {
+				values = append(values, fmt.Sprintf("%02x", value))
+			}
+		}
+		fmt.Fprintf(d.out, "0x%04x: %s\n", row, strings.Join(values, " "))
+	}
+}
+
+// readMemory reads length bytes of memory starting at start
+func (d *Debugger) readMemory(start uint16, length int) ([]byte, error) {
+	values := make([]byte, length)
+	for i := range values {
+		value, err := d.peek(start + uint16(i))
+		if err != nil {
+			return values, err
+		}
+		values[i] = value
+	}
+	return values, nil
+}
+
+// peek reads a byte of RAM or ROM, devices aren't read as reading them has side effects (it would
+// use up console input or advance the random number generator) so their addresses give an error
+func (d *Debugger) peek(address uint16) (uint8, error) {
+	value, ok := d.Chip.Peek(address)
+	if !ok {
+		return 0, fmt.Errorf("0x%04x is not RAM or ROM", address)
+	}
+	return value, nil
+}
+
+func min(a, b int) int {
+	if a > b {
+		return b
+	}
+	return a
+}
+
+const helpText = `commands:
+  step [n], s [n]          execute n instructions (default 1)
+  continue, c              run until a breakpoint, watchpoint or halt
+  back [n], bk [n]         step back n instructions (default 1)
+  last <$reg|addr|.label>  step back to the last instruction that wrote a register or memory location
+  break <addr|.label>, b   set a breakpoint
+  delete <addr|.label>, d  remove a breakpoint
+  watch <$reg|addr|.label> stop when a register or memory location changes
+  unwatch <$reg|addr|.label>
+  info, i                  list breakpoints and watchpoints
+  regs, r                  print the registers, flags and next instruction
+  mem <addr|.label> [n]    dump n bytes of memory
+  quit, q                  exit the debugger
+`
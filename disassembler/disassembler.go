@@ -0,0 +1,144 @@
+package disassembler
+
+import (
+	"bufio"
+	"cheepcheep/isa"
+	"cheepcheep/symbols"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// Disassembly is a lot simpler than assembly, every instruction is 4 bytes so we just walk the ROM
+// decoding each instruction in turn, the only real work is in synthesizing labels so that the output
+// can be fed straight back into the assembler and reproduce the same bytes
+
+// Line is a single decoded instruction in a ROM
+type Line struct {
+	Address     uint16
+	Raw         []byte
+	Instruction isa.Instruction
+
+	// Valid is false if the bytes at this address don't decode to an instruction that
+	// encodes back to the same bytes, this is usually data placed by a directive
+	Valid bool
+}
+
+// Decode walks a ROM and decodes every instruction in it
+func Decode(rom []byte) []Line {
+	lines := []Line{}
+	for address := 0; address < len(rom); address += isa.InstructionSize {
+		var encoded [isa.InstructionSize]byte
+		raw := rom[address:min(address+isa.InstructionSize, len(rom))]
+		copy(encoded[:], raw)
+
+		instruction, err := isa.Decode(encoded)
+		reencoded, _ := isa.Encode(instruction)
+		lines = append(lines, Line{
+			Address:     uint16(address),
+			Raw:         raw,
+			Instruction: instruction,
+			Valid:       err == nil && len(raw) == isa.InstructionSize && reencoded == encoded,
+		})
+	}
+	return lines
+}
+
+// Disassemble turns a ROM back into .chippy source and writes it out to w, if a symbol table is
+// provided its labels are used, otherwise labels are synthesized for every address an instruction refers to
+func Disassemble(rom []byte, table *symbols.Table, w io.Writer) error {
+	lines := Decode(rom)
+	labels := computeLabels(lines, len(rom), table)
+
+	output := bufio.NewWriter(w)
+	for _, line := range lines {
+		writeLabels(output, labels, line.Address)
+		// instructions referring to an address we couldn't label can
+		// only be reproduced as raw data
+		_, hasLabel := labels[line.Instruction.Value]
+		if !line.Valid || (isAddressed(line.Instruction) && !hasLabel) {
+			fmt.Fprintf(output, "    %s\n", formatData(line.Raw))
+			continue
+		}
+		fmt.Fprintf(output, "    %s\n", formatInstruction(line.Instruction, labels))
+	}
+
+	// labels can also point just past the final instruction
+	writeLabels(output, labels, uint16(len(rom)))
+	return output.Flush()
+}
+
+// computeLabels determines the label for every address we need to refer to, an instruction whose operand
+// is an immediate address (eg. a jump to a label) can only be reassembled if that address has a label
+// labels can only be placed at instruction boundaries within the ROM or at the very end of the ROM
+func computeLabels(lines []Line, romSize int, table *symbols.Table) map[uint16][]string {
+	labels := map[uint16][]string{}
+	canLabel := func(address uint16) bool {
+		return int(address) <= romSize && address%isa.InstructionSize == 0
+	}
+
+	if table != nil {
+		for label, address := range table.Labels {
+			// names generated by macro expansion or linking (eg. .loop@m1) can't be written in source
+			// so they'd stop the output from reassembling, a synthesized label is used instead
+			if canLabel(address) && !strings.ContainsRune(label, '@') {
+				labels[address] = append(labels[address], label)
+			}
+		}
+		for _, names := range labels {
+			sort.Strings(names)
+		}
+	}
+
+	for _, line := range lines {
+		target := line.Instruction.Value
+		if !line.Valid || !isAddressed(line.Instruction) || !canLabel(target) {
+			continue
+		}
+		if _, exists := labels[target]; !exists {
+			labels[target] = []string{fmt.Sprintf(".L%04x", target)}
+		}
+	}
+	return labels
+}
+
+func writeLabels(output io.Writer, labels map[uint16][]string, address uint16) {
+	for _, label := range labels[address] {
+		fmt.Fprintln(output, label)
+	}
+}
+
+// isAddressed determines if an instruction's flexible operand is an immediate address
+func isAddressed(instruction isa.Instruction) bool {
+	return isa.OPCODES[instruction.Opcode].Addressed && instruction.Mode == isa.Immediate
+}
+
+// formatInstruction formats an instruction in chippy syntax, substituting labels for immediate addresses
+// the caller must make sure a label exists for any immediate address
+func formatInstruction(instruction isa.Instruction, labels map[uint16][]string) string {
+	formatted := instruction.String()
+	if !isAddressed(instruction) {
+		return formatted
+	}
+
+	// immediate operands are always the final operand, so swap it out for the label
+	operand := instruction.FormatOperand()
+	return strings.TrimSuffix(formatted, operand) + labels[instruction.Value][0]
+}
+
+// formatData formats raw bytes that aren't an instruction as a .byte directive
+func formatData(raw []byte) string {
+	values := make([]string, len(raw))
+	for i, value := range raw {
+		values[i] = fmt.Sprintf("%d", value)
+	}
+	return ".byte " + strings.Join(values, ", ")
+}
+
+func min(a, b int) int {
+	if a > b {
+		return b
+	}
+	return a
+}
@@ -0,0 +1,167 @@
+package disassembler
+
+import (
+	"bufio"
+	"bytes"
+	"cheepcheep/chippy"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// assemble runs source through the assembler and returns the compiled bytes
+func assemble(t *testing.T, name string, source string) []byte {
+	t.Helper()
+	nodes, err := chippy.Parse(name, *bufio.NewReader(strings.NewReader(source)))
+	if err != nil {
+		t.Fatalf("failed to parse %s:\n%s", name, err)
+	}
+	compiled, err := chippy.Compile(nodes)
+	if err != nil {
+		t.Fatalf("failed to compile %s:\n%s", name, err)
+	}
+	rom, err := io.ReadAll(compiled)
+	if err != nil {
+		t.Fatalf("failed to read compiled output of %s: %s", name, err)
+	}
+	return rom
+}
+
+// assertRoundTrip checks that disassembling and reassembling a program reproduces identical bytes
+func assertRoundTrip(t *testing.T, name string, source string) {
+	t.Helper()
+	rom := assemble(t, name, source)
+
+	var disassembly bytes.Buffer
+	if err := Disassemble(rom, nil, &disassembly); err != nil {
+		t.Fatalf("failed to disassemble %s: %s", name, err)
+	}
+
+	reassembled := assemble(t, name+" (disassembled)", disassembly.String())
+	if !bytes.Equal(rom, reassembled) {
+		t.Errorf("round trip of %s changed the output\noriginal:    % x\nreassembled: % x\ndisassembly:\n%s",
+			name, rom, reassembled, disassembly.String())
+	}
+}
+
+func TestRoundTripROMs(t *testing.T) {
+	roms, _ := filepath.Glob("../ROMs/*.chippy")
+	if len(roms) == 0 {
+		t.Fatal("no ROMs found")
+	}
+
+	for _, rom := range roms {
+		source, err := os.ReadFile(rom)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Run(filepath.Base(rom), func(t *testing.T) {
+			assertRoundTrip(t, rom, string(source))
+		})
+	}
+}
+
+func TestRoundTripAddressingModes(t *testing.T) {
+	assertRoundTrip(t, "modes.chippy", `
+.start
+	mov $r1, #5
+	mov $r2, $r1
+	mov $r3, .end
+	ldr $r4, [100]
+	ldr $r5, 3+$r2
+	ldr $r6, #(8)
+	str $r1, .start
+	str $r1, $r2
+	str $r13, 10+$sp
+	add $r1, $zero
+	jmp 4+$bp
+	jmpge #(12)
+	jmp .end
+.end
+`)
+}
+
+func TestRoundTripStack(t *testing.T) {
+	assertRoundTrip(t, "stack.chippy", `
+	push #42
+	push $r1
+	pop $r2
+	call .sub
+	call 8+$r3
+	hlt
+.sub
+	enter #4
+	leave
+	ret
+`)
+}
+
+func TestRoundTripWords(t *testing.T) {
+	assertRoundTrip(t, "words.chippy", `
+	ldw $r1, [.value]
+	stw $r1, 2+$r2
+	hlt
+.value
+	.word 1000
+`)
+}
+
+func TestRoundTripConditionalJumps(t *testing.T) {
+	assertRoundTrip(t, "jumps.chippy", `
+.top
+	jeq .top
+	jne .top
+	jb .top
+	jae .top
+	jbe .top
+	ja .top
+	hlt
+`)
+}
+
+func TestRoundTripInterrupts(t *testing.T) {
+	assertRoundTrip(t, "interrupts.chippy", `
+	ei
+	di
+	hlt
+	iret
+`)
+}
+
+func TestSymbolsAreUsedForLabels(t *testing.T) {
+	source := "jmp .target\n.target\nhlt\n"
+	nodes, err := chippy.Parse("labels.chippy", *bufio.NewReader(strings.NewReader(source)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	table, err := chippy.DebugInfo(nodes)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var disassembly bytes.Buffer
+	if err := Disassemble(assemble(t, "labels.chippy", source), table, &disassembly); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(disassembly.String(), "jmp .target\n.target\n") {
+		t.Errorf("expected the label from the symbol table to be used, got:\n%s", disassembly.String())
+	}
+}
+
+func TestRoundTripData(t *testing.T) {
+	assertRoundTrip(t, "data.chippy", `
+	ldr $r1, .msg
+	jmp .end
+.msg
+	.asciiz "hello, world"
+	.word .msg, 300, -1
+	.byte 1, 2, 3
+	.space 3, 255
+	.org 64
+.end
+	hlt
+	jmp [4097]
+`)
+}
@@ -0,0 +1,182 @@
+package emulator
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+)
+
+/**
+The bus:
+	- Every memory access the CPU makes (including instruction fetches) goes through its Bus
+	- The default bus is a MemoryMap which splits the 16 bit address space into regions, each backed by
+	  RAM, ROM or a device, accessing an address outside of every region is a fault
+	- The default layout (see NewChip) is:
+		- 0x0000 - 0xEFFF: RAM, programs are loaded from 0x0000 and the stack sits at the top (see stack.go)
+		- 0xF000 - 0xFFFF: reserved for memory mapped devices, unmapped unless a device is attached
+*/
+
+// Bus connects the CPU to memory and devices
+type Bus interface {
+	Read(address uint16) (uint8, error)
+	Write(address uint16, value uint8) error
+}
+
+// Region is a block of the address space backed by a single memory or device, regions
+// are addressed by their offset from the start of the region
+type Region interface {
+	Size() int
+	Read(offset uint16) (uint8, error)
+	Write(offset uint16, value uint8) error
+}
+
+const (
+	// DeviceBase is the start of the region reserved for memory mapped devices, everything
+	// below it is RAM in the default layout
+	DeviceBase uint16 = 0xF000
+)
+
+// StandardMemoryMap builds the default layout, the first romSize bytes are mapped as ROM
+// (so a program can't overwrite itself) and the rest of the space below DeviceBase is RAM
+func StandardMemoryMap(romSize int) *MemoryMap {
+	memory := NewMemoryMap()
+	if romSize > int(DeviceBase) {
+		romSize = int(DeviceBase)
+	}
+	if romSize > 0 {
+		memory.Map(0, make(ROM, romSize))
+	}
+	if romSize < int(DeviceBase) {
+		memory.Map(uint16(romSize), make(RAM, int(DeviceBase)-romSize))
+	}
+	return memory
+}
+
+// memory faults
+var (
+	ErrUnmappedAddress = errors.New("access to unmapped address")
+	ErrWriteProtected  = errors.New("write to read only address")
+)
+
+// RAM is readable and writable memory
+type RAM []uint8
+
+func (r RAM) Size() int                              { return len(r) }
+func (r RAM) Read(offset uint16) (uint8, error)      { return r[offset], nil }
+func (r RAM) Write(offset uint16, value uint8) error { r[offset] = value; return nil }
+
+// ROM is read only memory, its contents can only be set when a program is loaded
+type ROM []uint8
+
+func (r ROM) Size() int                              { return len(r) }
+func (r ROM) Read(offset uint16) (uint8, error)      { return r[offset], nil }
+func (r ROM) Write(offset uint16, value uint8) error { return ErrWriteProtected }
+
+// mapping places a region in the address space, end is exclusive so it may be 0x10000
+type mapping struct {
+	start  uint16
+	end    int
+	region Region
+}
+
+// MemoryMap is a Bus made up of non overlapping regions
+type MemoryMap struct {
+	mappings []mapping
+}
+
+// NewMemoryMap returns an empty memory map, every address is unmapped until a region is mapped over it
+func NewMemoryMap() *MemoryMap {
+	return &MemoryMap{}
+}
+
+// Map places a region in the address space starting at start
+func (m *MemoryMap) Map(start uint16, region Region) error {
+	end := int(start) + region.Size()
+	if region.Size() == 0 || end > 0x10000 {
+		return fmt.Errorf("region of %d bytes at 0x%04x does not fit in the address space", region.Size(), start)
+	}
+	for _, existing := range m.mappings {
+		if int(start) < existing.end && end > int(existing.start) {
+			return fmt.Errorf("region 0x%04x-0x%04x overlaps the region 0x%04x-0x%04x", start, end-1, existing.start, existing.end-1)
+		}
+	}
+
+	m.mappings = append(m.mappings, mapping{start, end, region})
+	sort.Slice(m.mappings, func(i, j int) bool { return m.mappings[i].start < m.mappings[j].start })
+	return nil
+}
+
+// find looks up the region an address belongs to along with the address' offset within it
+func (m *MemoryMap) find(address uint16) (Region, uint16, bool) {
+	i := sort.Search(len(m.mappings), func(i int) bool { return m.mappings[i].end > int(address) })
+	if i == len(m.mappings) || address < m.mappings[i].start {
+		return nil, 0, false
+	}
+	return m.mappings[i].region, address - m.mappings[i].start, true
+}
+
+func (m *MemoryMap) Read(address uint16) (uint8, error) {
+	region, offset, ok := m.find(address)
+	if !ok {
+		return 0, fmt.Errorf("%w 0x%04x", ErrUnmappedAddress, address)
+	}
+	return region.Read(offset)
+}
+
+func (m *MemoryMap) Write(address uint16, value uint8) error {
+	region, offset, ok := m.find(address)
+	if !ok {
+		return fmt.Errorf("%w 0x%04x", ErrUnmappedAddress, address)
+	}
+	if err := region.Write(offset, value); err != nil {
+		return fmt.Errorf("%w 0x%04x", err, address)
+	}
+	return nil
+}
+
+// Tick ticks every region that keeps time
+func (m *MemoryMap) Tick() {
+	for _, mapping := range m.mappings {
+		if ticker, ok := mapping.region.(Ticker); ok {
+			ticker.Tick()
+		}
+	}
+}
+
+// Load copies data into memory starting at address, unlike Write it can fill ROM, every
+// address must be backed by RAM or ROM
+func (m *MemoryMap) Load(address uint16, data []uint8) error {
+	for i, value := range data {
+		target := int(address) + i
+		region, offset, ok := m.find(uint16(target))
+		if !ok || target > 0xFFFF {
+			return fmt.Errorf("%w 0x%04x", ErrUnmappedAddress, target)
+		}
+
+		switch memory := region.(type) {
+		case RAM:
+			memory[offset] = value
+		case ROM:
+			memory[offset] = value
+		default:
+			return fmt.Errorf("cannot load data into the device at 0x%04x", target)
+		}
+	}
+	return nil
+}
+
+// Peek reads an address backed by RAM or ROM, unlike Read it never touches a device (reading
+// a device can have side effects) so ok is false for device and unmapped addresses
+func (m *MemoryMap) Peek(address uint16) (value uint8, ok bool) {
+	region, offset, found := m.find(address)
+	if !found {
+		return 0, false
+	}
+	switch memory := region.(type) {
+	case RAM:
+		return memory[offset], true
+	case ROM:
+		return memory[offset], true
+	}
+	return 0, false
+}
@@ -0,0 +1,367 @@
+package emulator
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math/rand"
+)
+
+/**
+Memory mapped devices:
+	- Devices are regions on the bus (see bus.go), the standard devices live in the device window at 0xF000
+	- Devices that need to keep time implement Ticker, the memory map ticks them once per clock cycle (see timing.go)
+
+	Console (ConsoleBase, 2 bytes)
+		+0 DATA    reading returns the next byte of input (0 if there is none), writing outputs a byte
+		+1 STATUS  read only, bit 0 is set if input is available and bit 1 once the input has ended
+		Raises IRQConsole once for each byte of input as it becomes available (see interrupts.go)
+
+	Timer (TimerBase, 4 bytes), a 16 bit countdown timer
+		+0 COUNT_HI  reading returns the high byte of the current count, writing latches the high byte of the reload value
+		+1 COUNT_LO  reading returns the low byte of the current count, writing sets the reload value (using the latched
+		             high byte) and restarts the count from it
+		+2 CONTROL   bit 0 enables the timer, bit 1 makes it reload and keep running once it expires
+		+3 STATUS    bit 0 is set when the count reaches zero, writing any value clears it
+		Raises IRQTimer each time the count reaches zero
+
+	Random (RandomBase, 1 byte)
+		+0 DATA  reading returns the next pseudo random byte, writing reseeds the generator with the value
+*/
+
+// addresses of the standard devices
+const (
+	ConsoleBase uint16 = 0xF000
+	TimerBase   uint16 = 0xF010
+	RandomBase  uint16 = 0xF020
+)
+
+// Ticker is implemented by devices that need to keep time
+type Ticker interface {
+	Tick()
+}
+
+// Stateful is implemented by devices whose state is saved in snapshots (see snapshot.go), the console
+// isn't stateful as its input and output belong to whoever is running the chip. DecodeState checks a
+// saved state without touching the device and returns a function that restores it, so a snapshot can
+// check every device's state before any of them are changed
+type Stateful interface {
+	SaveState() []uint8
+	DecodeState(state []uint8) (restore func(), err error)
+}
+
+// Devices is the standard set of devices
+type Devices struct {
+	Console    *Console
+	Timer      *Timer
+	Random     *Random
+	Interrupts *InterruptController
+}
+
+// NewDevices builds the standard devices, the console reads from in and writes to out
+// and the random number generator is seeded with seed so runs can be reproduced
+func NewDevices(in io.Reader, out io.Writer, seed int64) Devices {
+	interrupts := &InterruptController{}
+	console := NewConsole(in, out)
+	console.Interrupts = interrupts
+	return Devices{
+		Console:    console,
+		Timer:      &Timer{Interrupts: interrupts},
+		Random:     NewRandom(seed),
+		Interrupts: interrupts,
+	}
+}
+
+// Attach maps the devices onto a memory map at their standard addresses
+func (d Devices) Attach(memory *MemoryMap) error {
+	if err := memory.Map(ConsoleBase, d.Console); err != nil {
+		return err
+	}
+	if err := memory.Map(TimerBase, d.Timer); err != nil {
+		return err
+	}
+	if err := memory.Map(RandomBase, d.Random); err != nil {
+		return err
+	}
+	return memory.Map(InterruptBase, d.Interrupts)
+}
+
+// Console is a character device backed by a reader and a writer
+type Console struct {
+	in  *bufio.Reader
+	out io.Writer
+
+	// Interrupts, if set, is raised on IRQConsole when a byte of input becomes available,
+	// raised records that the waiting byte has already raised it
+	Interrupts *InterruptController
+	raised     bool
+
+	// interactive consoles read their input in the background so checking the status never
+	// blocks, the next byte waits in next until it is read
+	interactive <-chan byte
+	next        *byte
+	ended       bool
+}
+
+// NewConsole builds a console, in may be nil if there is no input, checking the status blocks
+// until input is available or has ended which keeps runs reproducible
+func NewConsole(in io.Reader, out io.Writer) *Console {
+	console := &Console{out: out}
+	if in != nil {
+		console.in = bufio.NewReader(in)
+	}
+	return console
+}
+
+// NewInteractiveConsole builds a console whose input is typed in while the program runs (e.g. standard in),
+// the input is read in the background so the status reports no input instead of waiting for it
+func NewInteractiveConsole(in io.Reader, out io.Writer) *Console {
+	input := make(chan byte)
+	go func() {
+		reader := bufio.NewReader(in)
+		for {
+			value, err := reader.ReadByte()
+			if err != nil {
+				close(input)
+				return
+			}
+			input <- value
+		}
+	}()
+	return &Console{out: out, interactive: input}
+}
+
+// status reports whether a byte of input is available and whether the input has ended
+func (c *Console) status() (available bool, ended bool) {
+	if c.interactive != nil {
+		if c.next == nil && !c.ended {
+			select {
+			case value, ok := <-c.interactive:
+				if ok {
+					c.next = &value
+				} else {
+					c.ended = true
+				}
+			default:
+			}
+		}
+		return c.next != nil, c.next == nil && c.ended
+	}
+
+	// without any input the console behaves as if the input has ended
+	if c.in == nil {
+		return false, true
+	}
+
+	// peeking blocks until input is available or the input ends
+	_, err := c.in.Peek(1)
+	return err == nil, err == io.EOF
+}
+
+func (c *Console) Size() int { return 2 }
+
+func (c *Console) Read(offset uint16) (uint8, error) {
+	if offset == 0 {
+		if available, _ := c.status(); !available {
+			return 0, nil
+		}
+		c.raised = false
+		if c.interactive != nil {
+			value := *c.next
+			c.next = nil
+			return value, nil
+		}
+		value, _ := c.in.ReadByte()
+		return value, nil
+	}
+
+	var status uint8 = 0
+	available, ended := c.status()
+	if available {
+		status |= 0x1
+	}
+	if ended {
+		status |= 0x2
+	}
+	return status, nil
+}
+
+func (c *Console) Write(offset uint16, value uint8) error {
+	if offset != 0 {
+		return ErrWriteProtected
+	}
+	if c.out != nil {
+		_, err := c.out.Write([]byte{value})
+		return err
+	}
+	return nil
+}
+
+// Tick raises the console's interrupt once a byte of input is waiting to be read, the status
+// is only checked when the line is enabled so an unused console never waits on its input
+func (c *Console) Tick() {
+	if c.Interrupts == nil || c.raised || c.Interrupts.Enabled&(1<<IRQConsole) == 0 {
+		return
+	}
+	if available, _ := c.status(); available {
+		c.Interrupts.Raise(IRQConsole)
+		c.raised = true
+	}
+}
+
+// Timer is a programmable 16 bit countdown timer
+type Timer struct {
+	Reload  uint16
+	Count   uint16
+	Control uint8
+	Expired bool
+
+	// Interrupts, if set, is raised on IRQTimer when the timer expires
+	Interrupts *InterruptController
+
+	// latch holds the high byte of the reload value until the low byte is written
+	latch uint8
+}
+
+// timer control bits
+const (
+	TimerEnable uint8 = 0x1
+	TimerRepeat uint8 = 0x2
+)
+
+func (t *Timer) Size() int { return 4 }
+
+func (t *Timer) Read(offset uint16) (uint8, error) {
+	switch offset {
+	case 0:
+		return uint8(t.Count >> 8), nil
+	case 1:
+		return uint8(t.Count), nil
+	case 2:
+		return t.Control, nil
+	}
+	if t.Expired {
+		return 0x1, nil
+	}
+	return 0, nil
+}
+
+func (t *Timer) Write(offset uint16, value uint8) error {
+	switch offset {
+	case 0:
+		t.latch = value
+	case 1:
+		t.Reload = uint16(t.latch)<<8 | uint16(value)
+		t.Count = t.Reload
+	case 2:
+		t.Control = value
+	case 3:
+		t.Expired = false
+	}
+	return nil
+}
+
+// Tick counts the timer down by one, once it reaches zero the timer expires and
+// either reloads or disables itself
+func (t *Timer) Tick() {
+	if t.Control&TimerEnable == 0 || t.Count == 0 {
+		return
+	}
+
+	t.Count--
+	if t.Count == 0 {
+		t.Expired = true
+		if t.Interrupts != nil {
+			t.Interrupts.Raise(IRQTimer)
+		}
+		if t.Control&TimerRepeat != 0 {
+			t.Count = t.Reload
+		} else {
+			t.Control &^= TimerEnable
+		}
+	}
+}
+
+// ErrDeviceState is returned when restoring a device from state that doesn't belong to it
+var ErrDeviceState = errors.New("malformed device state")
+
+// SaveState stores the timer's registers: reload, count, control, expired and the latched byte
+func (t *Timer) SaveState() []uint8 {
+	state := []uint8{0, 0, 0, 0, t.Control, 0, t.latch}
+	binary.BigEndian.PutUint16(state[0:], t.Reload)
+	binary.BigEndian.PutUint16(state[2:], t.Count)
+	if t.Expired {
+		state[5] = 1
+	}
+	return state
+}
+
+func (t *Timer) DecodeState(state []uint8) (func(), error) {
+	if len(state) != 7 {
+		return nil, ErrDeviceState
+	}
+	return func() {
+		t.Reload, t.Count = binary.BigEndian.Uint16(state[0:]), binary.BigEndian.Uint16(state[2:])
+		t.Control, t.Expired, t.latch = state[4], state[5] != 0, state[6]
+	}, nil
+}
+
+// Random is a seeded pseudo random number generator
+type Random struct {
+	source *rand.Rand
+
+	// the generator's state can't be read back out so it is saved as the seed
+	// and the number of bytes generated since seeding
+	seed  int64
+	drawn uint64
+}
+
+// maxRandomDraws bounds the bytes a restored generator has to replay, once that many bytes have been generated
+// the generator reseeds itself from its own output so the sequence stays the same for a given seed
+const maxRandomDraws = 1 << 20
+
+// NewRandom builds a random number generator, the same seed always produces the same sequence
+func NewRandom(seed int64) *Random {
+	return &Random{source: rand.New(rand.NewSource(seed)), seed: seed}
+}
+
+func (r *Random) Size() int { return 1 }
+
+func (r *Random) Read(offset uint16) (uint8, error) {
+	value := uint8(r.source.Intn(256))
+	if r.drawn++; r.drawn == maxRandomDraws {
+		r.seed, r.drawn = r.source.Int63(), 0
+		r.source.Seed(r.seed)
+	}
+	return value, nil
+}
+
+func (r *Random) Write(offset uint16, value uint8) error {
+	r.source.Seed(int64(value))
+	r.seed, r.drawn = int64(value), 0
+	return nil
+}
+
+// SaveState stores the seed followed by the number of bytes generated since
+func (r *Random) SaveState() []uint8 {
+	state := make([]uint8, 16)
+	binary.BigEndian.PutUint64(state[0:], uint64(r.seed))
+	binary.BigEndian.PutUint64(state[8:], r.drawn)
+	return state
+}
+
+// DecodeState restores the generator by reseeding it and generating the same number of bytes
+// again to bring it back to where it was, a generator never has maxRandomDraws or more to replay
+func (r *Random) DecodeState(state []uint8) (func(), error) {
+	if len(state) != 16 || binary.BigEndian.Uint64(state[8:]) >= maxRandomDraws {
+		return nil, ErrDeviceState
+	}
+	return func() {
+		r.seed, r.drawn = int64(binary.BigEndian.Uint64(state[0:])), 0
+		r.source.Seed(r.seed)
+		for count := binary.BigEndian.Uint64(state[8:]); r.drawn < count; {
+			r.Read(0)
+		}
+	}, nil
+}
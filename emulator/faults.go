@@ -0,0 +1,169 @@
+package emulator
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+/**
+Faults:
+	- PerformNextComputation returns a *Fault once the chip stops, either because it executed HLT or because
+	  an instruction couldn't be executed, the chip is then halted with Pc left on the instruction responsible
+	- HLT is reported with the kind FaultHalt, every other kind is a real fault and is kept in Chipster.Fault
+	- The kinds of fault are:
+		halt                     the chip executed HLT (or was already halted)
+		illegal opcode           the opcode isn't in the isa's opcode table
+		illegal addressing mode  an instruction without a flexible operand was encoded with a mode other than immediate
+		memory                   reading or writing an address failed (it is unmapped, read only or the device refused)
+		stack                    the stack overflowed or underflowed (see stack.go)
+	- There is no bad register fault, an instruction's register fields are 4 bits wide so they can only name one
+	  of the isa.NumRegisters (16) registers that exist
+	- A fault wraps the error behind it so errors.Is works with both the sentinels below and those of the bus and stack
+*/
+
+// FaultKind classifies what stopped the chip
+type FaultKind int
+
+const (
+	FaultHalt FaultKind = iota
+	FaultIllegalOpcode
+	FaultIllegalAddressingMode
+	FaultMemory
+	FaultStack
+)
+
+var faultNames = map[FaultKind]string{
+	FaultHalt:                  "halt",
+	FaultIllegalOpcode:         "illegal-opcode",
+	FaultIllegalAddressingMode: "illegal-addressing-mode",
+	FaultMemory:                "memory",
+	FaultStack:                 "stack",
+}
+
+func (k FaultKind) String() string {
+	if name, ok := faultNames[k]; ok {
+		return name
+	}
+	return fmt.Sprintf("FaultKind(%d)", int(k))
+}
+
+// parseFaultKind is the inverse of FaultKind.String
+func parseFaultKind(name string) (FaultKind, bool) {
+	for kind, kindName := range faultNames {
+		if kindName == name {
+			return kind, true
+		}
+	}
+	return 0, false
+}
+
+// CPU faults, memory and stack faults are reported with the errors from bus.go and stack.go
+var (
+	ErrHalted                = errors.New("halted")
+	ErrIllegalOpcode         = errors.New("illegal opcode")
+	ErrIllegalAddressingMode = errors.New("illegal addressing mode")
+)
+
+// Fault is the error returned once the chip stops, Pc is the address of the instruction that stopped it
+type Fault struct {
+	Kind FaultKind
+	Pc   uint16
+	Err  error
+}
+
+func (f *Fault) Error() string {
+	return fmt.Sprintf("%s at 0x%04x", f.Err, f.Pc)
+}
+
+func (f *Fault) Unwrap() error {
+	return f.Err
+}
+
+// fault stops the chip on the instruction at origin, the fault is kept in Fault and returned, the kind
+// of fault is worked out from err
+func (c *Chipster) fault(err error, origin uint16) *Fault {
+	kind := FaultMemory
+	switch {
+	case errors.Is(err, ErrIllegalOpcode):
+		kind = FaultIllegalOpcode
+	case errors.Is(err, ErrIllegalAddressingMode):
+		kind = FaultIllegalAddressingMode
+	case errors.Is(err, ErrStackOverflow), errors.Is(err, ErrStackUnderflow):
+		kind = FaultStack
+	}
+
+	fault := &Fault{Kind: kind, Pc: origin, Err: err}
+	c.Pc = origin
+	c.Halted = true
+	c.Fault = fault
+	return fault
+}
+
+// stopReason describes why a halted chip stopped, the fault it hit or HLT
+func (c *Chipster) stopReason() error {
+	if c.Fault != nil {
+		return c.Fault
+	}
+	return &Fault{Kind: FaultHalt, Pc: c.Pc, Err: ErrHalted}
+}
+
+// Run executes instructions until the chip stops, limit instructions have been executed (0 means no limit), the
+// chip's CycleLimit is reached or ctx is cancelled, it returns the number of instructions executed and why it
+// stopped: nil if the chip halted with HLT or reached either limit, the chip's *Fault if it faulted or the
+// context's error if it was cancelled. Instructions take several cycles so the last one may take the chip past
+// its CycleLimit. If the chip has a ClockSpeed Run keeps to it (see timing.go)
+func (c *Chipster) Run(ctx context.Context, limit uint64) (uint64, error) {
+	var executed uint64
+	start, startCycles := time.Now(), c.Cycles
+	for limit == 0 || executed < limit {
+		select {
+		case <-ctx.Done():
+			return executed, ctx.Err()
+		default:
+		}
+
+		if c.Halted || (c.CycleLimit != 0 && c.Cycles >= c.CycleLimit) {
+			break
+		}
+		err := c.PerformNextComputation()
+		executed++
+		if err != nil {
+			break
+		}
+		if c.ClockSpeed != 0 {
+			c.throttle(ctx, start, c.Cycles-startCycles)
+		}
+	}
+
+	if c.Fault != nil {
+		return executed, c.Fault
+	}
+	return executed, nil
+}
+
+// describeFault formats a fault for a snapshot (see snapshot.go) as its kind, pc and reason
+func describeFault(fault error) string {
+	var f *Fault
+	if !errors.As(fault, &f) {
+		return fmt.Sprintf("%s 0 %q", FaultMemory, fault)
+	}
+	return fmt.Sprintf("%s %d %q", f.Kind, f.Pc, f.Err)
+}
+
+// parseFault is the inverse of describeFault, the reason is restored as a plain error
+func parseFault(description string) (*Fault, error) {
+	var name, reason string
+	fault := &Fault{}
+	if _, err := fmt.Sscanf(description, "%s %d %q", &name, &fault.Pc, &reason); err != nil {
+		return nil, fmt.Errorf("malformed fault %q: %w", description, err)
+	}
+	kind, ok := parseFaultKind(strings.TrimSpace(name))
+	if !ok {
+		return nil, fmt.Errorf("unknown kind of fault %q", name)
+	}
+	fault.Kind, fault.Err = kind, errors.New(reason)
+	return fault, nil
+}
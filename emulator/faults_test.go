@@ -0,0 +1,106 @@
+package emulator_test
+
+import (
+	"cheepcheep/chiptest"
+	"cheepcheep/emulator"
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestFaultKinds(t *testing.T) {
+	tests := []struct {
+		name   string
+		source string
+		kind   emulator.FaultKind
+		err    error
+		pc     uint16
+	}{
+		{"illegal opcode", "\tmov $r1, #1\n\t.byte 0xFC, 0, 0, 0\n", emulator.FaultIllegalOpcode, emulator.ErrIllegalOpcode, 4},
+		{"illegal addressing mode", "\t.byte 0x01, 0, 0, 0\n", emulator.FaultIllegalAddressingMode, emulator.ErrIllegalAddressingMode, 0},
+		{"memory", "\tmov $r1, #1\n\tldr $r1, [0xFFFF]\n", emulator.FaultMemory, emulator.ErrUnmappedAddress, 4},
+		{"stack", "\tpop $r1\n", emulator.FaultStack, emulator.ErrStackUnderflow, 0},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			result := chiptest.Run(t, test.source)
+			result.AssertFault(test.err)
+			result.AssertPc(test.pc)
+
+			var fault *emulator.Fault
+			if !errors.As(result.Chip.Fault, &fault) {
+				t.Fatalf("fault %v is not a *Fault", result.Chip.Fault)
+			}
+			if fault.Kind != test.kind || fault.Pc != test.pc {
+				t.Errorf("got a %s fault at 0x%04x, want a %s fault at 0x%04x", fault.Kind, fault.Pc, test.kind, test.pc)
+			}
+		})
+	}
+}
+
+func TestHaltIsReported(t *testing.T) {
+	result := chiptest.Run(t, `
+	mov $r1, #1
+	hlt
+`)
+	result.AssertNoFault()
+
+	// a halted chip keeps reporting the halt without executing anything
+	for i := 0; i < 2; i++ {
+		var fault *emulator.Fault
+		err := result.Chip.PerformNextComputation()
+		if !errors.As(err, &fault) || fault.Kind != emulator.FaultHalt || fault.Pc != 4 || !errors.Is(err, emulator.ErrHalted) {
+			t.Errorf("stepping a halted chip returned %v, want a halt at 0x0004", err)
+		}
+	}
+	result.AssertPc(4)
+}
+
+func TestRun(t *testing.T) {
+	chip := chiptest.Load(t, `
+.loop
+	add $r1, #1
+	jmp .loop
+`, chiptest.Options{})
+
+	executed, err := chip.Run(context.Background(), 10)
+	if executed != 10 || err != nil || chip.Halted {
+		t.Errorf("running 10 instructions executed %d and returned %v", executed, err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	executed, err = chip.Run(ctx, 0)
+	if executed != 0 || !errors.Is(err, context.Canceled) {
+		t.Errorf("running with a cancelled context executed %d and returned %v", executed, err)
+	}
+	if chip.ReadRegister(1) != 5 {
+		t.Errorf("$r1 = %d after 10 instructions, want 5", chip.ReadRegister(1))
+	}
+}
+
+func TestRunCycleLimit(t *testing.T) {
+	source := `
+.loop
+	add $r1, #1
+	jmp .loop
+`
+	chip := chiptest.Load(t, source, chiptest.Options{})
+	chip.CycleLimit = 20
+	executed, err := chip.Run(context.Background(), 0)
+	if err != nil || chip.Halted || chip.Cycles < 20 {
+		t.Fatalf("running to 20 cycles took %d cycles and returned %v", chip.Cycles, err)
+	}
+
+	// the run stops at the first instruction to start at or after the limit
+	reference := chiptest.Load(t, source, chiptest.Options{})
+	if _, err := reference.Run(context.Background(), executed-1); err != nil || reference.Cycles >= 20 {
+		t.Errorf("running to 20 cycles executed %d instructions but %d took %d cycles", executed, executed-1, reference.Cycles)
+	}
+
+	executed, err = chip.Run(context.Background(), 0)
+	if executed != 0 || err != nil {
+		t.Errorf("running past the cycle limit executed %d and returned %v", executed, err)
+	}
+}
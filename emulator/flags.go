@@ -0,0 +1,104 @@
+package emulator
+
+import (
+	"cheepcheep/isa"
+	"fmt"
+)
+
+/**
+The flag model:
+	- Every ALU operation and CMP sets all of the flags from its 16 bit result, CMP is a SUB that discards its result
+	- Z: the result is zero
+	- N: bit 15 of the result is set (the result is negative when read as a signed value)
+	- C: ADD carried out of bit 15, SUB/CMP borrowed (the register was below the operand as unsigned values),
+	     MUL's full product didn't fit in 16 bits, cleared by everything else
+	- V: ADD/SUB/CMP overflowed as signed values, MUL's full product didn't fit in 16 bits, cleared by everything else
+	- D: DIV divided by zero (the register is left unchanged), cleared by everything else
+
+After a CMP the signed jumps (JMPL, JMPG, JMPLE, JMPGE) compare the values as signed and the unsigned jumps
+(JB, JA, JBE, JAE) compare them as unsigned, JEQ and JNE work for both.
+*/
+
+// The bits of the Vf flag register
+const (
+	FlagZero         uint16 = 0x1
+	FlagNegative     uint16 = 0x2
+	FlagDivideByZero uint16 = 0x4
+	FlagCarry        uint16 = 0x8
+	FlagOverflow     uint16 = 0x10
+)
+
+// DescribeFlags returns a human readable view of the flag register
+func DescribeFlags(vf uint16) string {
+	isSet := func(flag uint16) int {
+		if vf&flag != 0 {
+			return 1
+		}
+		return 0
+	}
+	return fmt.Sprintf("Z=%d N=%d C=%d V=%d D=%d (0b%016b)", isSet(FlagZero), isSet(FlagNegative), isSet(FlagCarry),
+		isSet(FlagOverflow), isSet(FlagDivideByZero), vf)
+}
+
+// setFlags replaces the flag register with the flags describing an ALU result
+func (c *Chipster) setFlags(result uint16, carry, overflow, divideByZero bool) {
+	c.Vf = 0
+	if result == 0 {
+		c.Vf |= FlagZero
+	}
+	if result&0x8000 != 0 {
+		c.Vf |= FlagNegative
+	}
+	if carry {
+		c.Vf |= FlagCarry
+	}
+	if overflow {
+		c.Vf |= FlagOverflow
+	}
+	if divideByZero {
+		c.Vf |= FlagDivideByZero
+	}
+}
+
+// add adds two words returning the result, whether it carried and whether it overflowed as signed values
+func add(a, b uint16) (uint16, bool, bool) {
+	result := a + b
+	return result, result < a, (a^result)&(b^result)&0x8000 != 0
+}
+
+// subtract subtracts b from a returning the result, whether it borrowed and whether it overflowed as signed values
+func subtract(a, b uint16) (uint16, bool, bool) {
+	result := a - b
+	return result, a < b, (a^b)&(a^result)&0x8000 != 0
+}
+
+// conditionMet determines if a conditional jump should be taken given the current flags
+func (c *Chipster) conditionMet(opcode isa.Opcode) bool {
+	zero := c.Vf&FlagZero != 0
+	carry := c.Vf&FlagCarry != 0
+	less := (c.Vf&FlagNegative != 0) != (c.Vf&FlagOverflow != 0)
+
+	switch opcode {
+	case isa.JEQ:
+		return zero
+	case isa.JNE:
+		return !zero
+	case isa.JMPL:
+		return less
+	case isa.JMPGE:
+		return !less
+	case isa.JMPLE:
+		return less || zero
+	case isa.JMPG:
+		return !less && !zero
+	case isa.JB:
+		return carry
+	case isa.JAE:
+		return !carry
+	case isa.JBE:
+		return carry || zero
+	case isa.JA:
+		return !carry && !zero
+	}
+	return true
+}
@@ -0,0 +1,175 @@
+package emulator
+
+/**
+Reverse execution:
+	- History is opt in, EnableHistory(n) makes the chip keep an undo record for each of the last n steps it took,
+	  the oldest record is dropped once there are n of them so the history never grows
+	- A record holds whatever the step overwrote: the previous values of the registers and memory it wrote along
+	  with the program counter, flags, cycle count, interrupt and halt state the step started from
+	- StepBack undoes steps newest first, ReverseToRegisterWrite and ReverseToMemoryWrite undo steps until the
+	  most recent write to a register or address has been undone, leaving the chip on the instruction that made it
+	- Devices aren't rewound, a write to a device can't be taken back and input read from the console stays read.
+	  The interrupt controller is restored except that interrupts raised while the undone steps ran stay pending
+	- Stepping back doesn't touch the trace (see trace.go), a trace still holds the steps that were undone
+*/
+
+// undoRecord holds what's needed to undo a single step
+type undoRecord struct {
+	step              uint64
+	cycles            uint64
+	pc, vf            uint16
+	interruptsEnabled bool
+	halted            bool
+	fault             error
+	controller        InterruptController
+
+	// the previous values of the registers and memory the step wrote, in the order they were written
+	registers []RegisterWrite
+	memory    []MemoryWrite
+}
+
+// history is a ring buffer of the undo records of the most recent steps
+type history struct {
+	records []undoRecord
+	newest  int
+	length  int
+}
+
+// at returns the record of the step taken age steps before the most recent one
+func (h *history) at(age int) *undoRecord {
+	return &h.records[(h.newest-age+len(h.records))%len(h.records)]
+}
+
+// EnableHistory makes the chip remember how to undo its last limit steps, a limit of 0 turns
+// the history off, either way any steps already remembered are forgotten
+func (c *Chipster) EnableHistory(limit int) {
+	c.history = nil
+	if limit > 0 {
+		c.history = &history{records: make([]undoRecord, limit), newest: limit - 1}
+	}
+}
+
+// HistoryLength returns the number of steps that can currently be undone
+func (c *Chipster) HistoryLength() int {
+	if c.history == nil {
+		return 0
+	}
+	return c.history.length
+}
+
+// beginUndo starts recording how to undo the step about to be taken, once the history is
+// full the oldest record is overwritten (its slices are reused to save allocating every step)
+func (c *Chipster) beginUndo() {
+	h := c.history
+	if h == nil {
+		return
+	}
+	h.newest = (h.newest + 1) % len(h.records)
+	if h.length < len(h.records) {
+		h.length++
+	}
+
+	record := &h.records[h.newest]
+	*record = undoRecord{
+		step: c.steps, cycles: c.Cycles, pc: c.Pc, vf: c.Vf,
+		interruptsEnabled: c.InterruptsEnabled, halted: c.Halted, fault: c.Fault,
+		registers: record.registers[:0], memory: record.memory[:0],
+	}
+	if c.Interrupts != nil {
+		record.controller = *c.Interrupts
+	}
+	c.undo = record
+}
+
+// endUndo stops recording once the step is complete
+func (c *Chipster) endUndo() {
+	c.undo = nil
+}
+
+// Peek reads memory without side effects, ok is false if the address can't be read that way (see MemoryMap.Peek)
+func (c *Chipster) Peek(address uint16) (value uint8, ok bool) {
+	if peeker, canPeek := c.Bus.(interface{ Peek(uint16) (uint8, bool) }); canPeek {
+		return peeker.Peek(address)
+	}
+	return 0, false
+}
+
+// StepBack undoes up to n steps, newest first, it returns the number of steps undone which
+// is less than n if the history runs out
+func (c *Chipster) StepBack(n int) int {
+	for undone := 0; undone < n; undone++ {
+		if !c.undoStep() {
+			return undone
+		}
+	}
+	return n
+}
+
+// ReverseToRegisterWrite undoes steps up to and including the most recent one that wrote to the register
+// with the given isa index, if no remembered step wrote to it the chip is left alone and false is returned
+func (c *Chipster) ReverseToRegisterWrite(register uint8) bool {
+	return c.reverseTo(func(record *undoRecord) bool {
+		for _, write := range record.registers {
+			if write.Register == register {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+// ReverseToMemoryWrite undoes steps up to and including the most recent one that wrote to address,
+// if no remembered step wrote to it the chip is left alone and false is returned
+func (c *Chipster) ReverseToMemoryWrite(address uint16) bool {
+	return c.reverseTo(func(record *undoRecord) bool {
+		for _, write := range record.memory {
+			if write.Address == address {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+// reverseTo undoes steps up to and including the most recent one matching wrote
+func (c *Chipster) reverseTo(wrote func(record *undoRecord) bool) bool {
+	for age := 0; age < c.HistoryLength(); age++ {
+		if wrote(c.history.at(age)) {
+			c.StepBack(age + 1)
+			return true
+		}
+	}
+	return false
+}
+
+// undoStep undoes the most recent step in the history, it returns false if there isn't one
+func (c *Chipster) undoStep() bool {
+	h := c.history
+	if h == nil || h.length == 0 {
+		return false
+	}
+	record := h.at(0)
+
+	// writes are undone in reverse so a location written twice ends up with its original value
+	for i := len(record.registers) - 1; i >= 0; i-- {
+		c.writeRegister(record.registers[i].Register, record.registers[i].Value)
+	}
+	if loader, canLoad := c.Bus.(interface{ Load(uint16, []uint8) error }); canLoad {
+		for i := len(record.memory) - 1; i >= 0; i-- {
+			loader.Load(record.memory[i].Address, []uint8{record.memory[i].Value})
+		}
+	}
+
+	c.Pc, c.Vf = record.pc, record.vf
+	c.InterruptsEnabled, c.Halted, c.Fault = record.interruptsEnabled, record.halted, record.fault
+	c.steps, c.Cycles = record.step, record.cycles
+	if c.Interrupts != nil {
+		raised := c.Interrupts.Pending
+		*c.Interrupts = record.controller
+		c.Interrupts.Pending |= raised
+	}
+
+	h.newest = (h.newest - 1 + len(h.records)) % len(h.records)
+	h.length--
+	return true
+}
@@ -0,0 +1,131 @@
+package emulator_test
+
+import (
+	"cheepcheep/chiptest"
+	"cheepcheep/emulator"
+	"cheepcheep/isa"
+	"testing"
+)
+
+const historyProgram = `
+	mov $r1, #3
+.loop
+	push $r1
+	add $r2, $r1
+	sub $r1, #1
+	jne .loop
+	stw $r2, [.data]
+	call .sub
+	hlt
+.sub
+	mov $r3, #7
+	ret
+.data
+	.word 0xFFFF
+`
+
+// state is the part of the chip stepping back should restore
+type state struct {
+	registers      [14]uint16
+	stackRegisters [2]uint16
+	pc, vf         uint16
+	halted         bool
+	memory         [0x40]uint8
+	stack          [8]uint8
+}
+
+func capture(chip *emulator.Chipster) state {
+	s := state{registers: chip.Registers, stackRegisters: chip.StackRegisters, pc: chip.Pc, vf: chip.Vf, halted: chip.Halted}
+	for i := range s.memory {
+		s.memory[i], _ = chip.Bus.Read(uint16(i))
+	}
+	for i := range s.stack {
+		s.stack[i], _ = chip.Bus.Read(emulator.StackTop - uint16(len(s.stack)) + uint16(i))
+	}
+	return s
+}
+
+func TestStepBack(t *testing.T) {
+	chip := chiptest.Load(t, historyProgram, chiptest.Options{})
+	chip.EnableHistory(100)
+	states := []state{capture(chip)}
+	for !chip.Halted {
+		chip.PerformNextComputation()
+		states = append(states, capture(chip))
+	}
+	if chip.HistoryLength() != len(states)-1 {
+		t.Fatalf("history holds %d steps, want %d", chip.HistoryLength(), len(states)-1)
+	}
+
+	for i := len(states) - 2; i >= 0; i-- {
+		if undone := chip.StepBack(1); undone != 1 {
+			t.Fatalf("stepping back to step %d undid %d steps", i, undone)
+		}
+		if got := capture(chip); got != states[i] {
+			t.Fatalf("state after stepping back to step %d is\n%+v\nwant\n%+v", i, got, states[i])
+		}
+	}
+	if undone := chip.StepBack(1); undone != 0 {
+		t.Errorf("stepped back %d steps past the start of the history", undone)
+	}
+
+	// running forwards again retraces the same steps
+	for !chip.Halted {
+		chip.PerformNextComputation()
+	}
+	if got := capture(chip); got != states[len(states)-1] {
+		t.Errorf("state after running forwards again differs from the first run")
+	}
+}
+
+func TestHistoryLimit(t *testing.T) {
+	chip := chiptest.Load(t, historyProgram, chiptest.Options{})
+	chip.EnableHistory(4)
+	for i := 0; i < 10; i++ {
+		chip.PerformNextComputation()
+	}
+	want := capture(chip)
+	if undone := chip.StepBack(10); undone != 4 {
+		t.Fatalf("undid %d steps, want the 4 that were remembered", undone)
+	}
+	for i := 0; i < 4; i++ {
+		chip.PerformNextComputation()
+	}
+	if got := capture(chip); got != want {
+		t.Errorf("state after replaying the undone steps is\n%+v\nwant\n%+v", got, want)
+	}
+}
+
+func TestReverseToWrite(t *testing.T) {
+	chip := chiptest.Load(t, historyProgram, chiptest.Options{})
+	chip.EnableHistory(100)
+	for !chip.Halted {
+		chip.PerformNextComputation()
+	}
+
+	// the last write to $r1 is the final "sub $r1, #1" of the loop
+	if !chip.ReverseToRegisterWrite(isa.REGISTERS["r1"]) {
+		t.Fatal("no write to $r1 found")
+	}
+	if chip.ReadRegister(isa.REGISTERS["r1"]) != 1 || chip.Pc != 3*isa.InstructionSize {
+		t.Errorf("reversed to pc 0x%04x with $r1 = %d, want the sub at 0x%04x with $r1 = 1",
+			chip.Pc, chip.ReadRegister(isa.REGISTERS["r1"]), 3*isa.InstructionSize)
+	}
+
+	// the word at .data is written once, by the stw
+	for !chip.Halted {
+		chip.PerformNextComputation()
+	}
+	if !chip.ReverseToMemoryWrite(10 * isa.InstructionSize) {
+		t.Fatal("no write to .data found")
+	}
+	if chip.Pc != 5*isa.InstructionSize {
+		t.Errorf("reversed to pc 0x%04x, want the stw at 0x%04x", chip.Pc, 5*isa.InstructionSize)
+	}
+
+	// $r4 is never written so the chip is left where it is
+	pc := chip.Pc
+	if chip.ReverseToRegisterWrite(isa.REGISTERS["r4"]) || chip.Pc != pc {
+		t.Errorf("reversing to a register that was never written moved the chip")
+	}
+}
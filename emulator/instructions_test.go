@@ -0,0 +1,335 @@
+package emulator_test
+
+import (
+	"cheepcheep/chiptest"
+	"cheepcheep/emulator"
+	"strconv"
+	"testing"
+)
+
+func TestMoveAndPrint(t *testing.T) {
+	result := chiptest.Run(t, `
+	mov $r1, #42
+	mov $r2, $r1
+	mov $r3, #1000
+	mov $zero, #5
+	print $r2
+	print $r3
+	print $zero
+	hlt
+`)
+	result.AssertRegister("r1", 42)
+	result.AssertRegister("r2", 42)
+	result.AssertRegister("r3", 1000)
+	result.AssertRegister("zero", 0)
+	result.AssertOutput("Outputted: 42\nOutputted: 1000\nOutputted: 0\n")
+	result.AssertNoFault()
+}
+
+func TestHaltStopsExecution(t *testing.T) {
+	result := chiptest.Run(t, `
+	hlt
+	mov $r1, #1
+`)
+	result.AssertRegister("r1", 0)
+	result.AssertPc(0)
+	if result.Steps != 1 {
+		t.Errorf("executed %d instructions, want 1", result.Steps)
+	}
+}
+
+func TestAddressingModes(t *testing.T) {
+	result := chiptest.Run(t, `
+	mov $r2, .data
+	ldr $r1, #7          // immediate
+	mov $r3, $r1         // register
+	ldr $r4, [.data]     // direct
+	ldr $r5, 1+$r2       // register relative
+	ldr $r6, #(16)       // pc relative, .data is 16 bytes past this instruction
+	str $r1, 2+$r2
+	str $r1, [.data+3]
+	hlt
+.data
+	.byte 10, 20, 0, 0
+`)
+	result.AssertRegister("r1", 7)
+	result.AssertRegister("r3", 7)
+	result.AssertRegister("r4", 10)
+	result.AssertRegister("r5", 20)
+	result.AssertRegister("r6", 10)
+	result.AssertMemory(36, []byte{10, 20, 7, 7})
+}
+
+func TestWordLoadsAndStores(t *testing.T) {
+	result := chiptest.Run(t, `
+	ldw $r1, [.data]
+	ldr $r2, [.data]
+	mov $r3, #0x1234
+	stw $r3, [.data+2]
+	str $r3, [.data+4]
+	hlt
+.data
+	.word 0xBEEF
+	.space 3
+`)
+	result.AssertRegister("r1", 0xBEEF)
+	result.AssertRegister("r2", 0xBE)
+	result.AssertMemory(24, []byte{0xBE, 0xEF, 0x12, 0x34, 0x34})
+}
+
+func TestALU(t *testing.T) {
+	tests := []struct {
+		name      string
+		operation string
+		initial   int
+		operand   int
+		want      uint16
+		set       uint16
+		clear     uint16
+	}{
+		{"add", "add", 2, 3, 5, 0, emulator.FlagZero | emulator.FlagCarry | emulator.FlagOverflow},
+		{"add carry", "add", 0xFFFF, 1, 0, emulator.FlagZero | emulator.FlagCarry, emulator.FlagOverflow},
+		{"add overflow", "add", 0x7FFF, 1, 0x8000, emulator.FlagNegative | emulator.FlagOverflow, emulator.FlagCarry},
+		{"sub", "sub", 5, 3, 2, 0, emulator.FlagNegative | emulator.FlagCarry},
+		{"sub borrow", "sub", 3, 5, 0xFFFE, emulator.FlagNegative | emulator.FlagCarry, emulator.FlagOverflow},
+		{"sub overflow", "sub", 0x8000, 1, 0x7FFF, emulator.FlagOverflow, emulator.FlagNegative},
+		{"mul", "mul", 300, 3, 900, 0, emulator.FlagCarry | emulator.FlagOverflow},
+		{"mul overflow", "mul", 0x100, 0x100, 0, emulator.FlagZero | emulator.FlagCarry | emulator.FlagOverflow, 0},
+		{"div", "div", 100, 7, 14, 0, emulator.FlagDivideByZero},
+		{"div by zero", "div", 100, 0, 100, emulator.FlagDivideByZero, emulator.FlagZero},
+		{"xor", "xor", 0b1100, 0b1010, 0b0110, 0, emulator.FlagZero},
+		{"and", "and", 0b1100, 0b1010, 0b1000, 0, emulator.FlagZero},
+		{"and zero", "and", 0b0100, 0b1010, 0, emulator.FlagZero, 0},
+		{"or", "or", 0b1100, 0b1010, 0b1110, 0, emulator.FlagZero},
+		{"not", "not", 0, 0x00FF, 0xFF00, emulator.FlagNegative, emulator.FlagZero},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			result := chiptest.Run(t, "mov $r1, #"+strconv.Itoa(test.initial)+"\nmov $r2, #"+strconv.Itoa(test.operand)+
+				"\n"+test.operation+" $r1, $r2\nhlt\n")
+			result.AssertRegister("r1", test.want)
+			result.AssertFlags(test.set, test.clear)
+		})
+	}
+}
+
+func TestALUImmediate(t *testing.T) {
+	result := chiptest.Run(t, `
+	mov $r1, #10
+	add $r1, #5
+	sub $r1, #1
+	hlt
+`)
+	result.AssertRegister("r1", 14)
+}
+
+func TestConditionalJumps(t *testing.T) {
+	// each case compares a with b and records whether the jump was taken in $r3
+	tests := []struct {
+		jump  string
+		a, b  int
+		taken bool
+	}{
+		{"jeq", 5, 5, true},
+		{"jeq", 5, 6, false},
+		{"jne", 5, 6, true},
+		{"jne", 5, 5, false},
+		{"jmpl", -1, 1, true},
+		{"jlt", 1, -1, false},
+		{"jmpge", 1, -1, true},
+		{"jge", 1, 1, true},
+		{"jmple", 1, 1, true},
+		{"jle", 2, 1, false},
+		{"jmpg", 2, 1, true},
+		{"jgt", -2, 1, false},
+		{"jb", 1, -1, true},
+		{"jb", -1, 1, false},
+		{"jae", -1, 1, true},
+		{"jae", 1, 2, false},
+		{"jbe", 2, 2, true},
+		{"jbe", -1, 2, false},
+		{"ja", -1, 2, true},
+		{"ja", 2, 2, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.jump+" "+strconv.Itoa(test.a)+" "+strconv.Itoa(test.b), func(t *testing.T) {
+			result := chiptest.Run(t, "mov $r1, #"+strconv.Itoa(test.a)+"\nmov $r2, #"+strconv.Itoa(test.b)+
+				"\ncmp $r1, $r2\n"+test.jump+" .taken\nhlt\n.taken\nmov $r3, #1\nhlt\n")
+			var want uint16
+			if test.taken {
+				want = 1
+			}
+			result.AssertRegister("r3", want)
+		})
+	}
+}
+
+func TestCompareLeavesRegister(t *testing.T) {
+	result := chiptest.Run(t, `
+	mov $r1, #3
+	cmp $r1, #3
+	hlt
+`)
+	result.AssertRegister("r1", 3)
+	result.AssertFlags(emulator.FlagZero, emulator.FlagNegative|emulator.FlagCarry)
+}
+
+func TestJumps(t *testing.T) {
+	result := chiptest.Run(t, `
+	mov $r1, .second
+	jmp .first
+	hlt
+.first
+	add $r2, #1
+	jmp 0+$r1
+	hlt
+.second
+	add $r2, #1
+	jmp #(8)
+	hlt
+	add $r2, #1
+	hlt
+`)
+	result.AssertRegister("r2", 3)
+}
+
+func TestLoop(t *testing.T) {
+	result := chiptest.Run(t, `
+	mov $r1, #0
+.loop
+	add $r1, #1
+	cmp $r1, #1000
+	jb .loop
+	hlt
+`)
+	result.AssertRegister("r1", 1000)
+}
+
+func TestPushAndPop(t *testing.T) {
+	result := chiptest.Run(t, `
+	mov $r1, #0x1234
+	push $r1
+	push #7
+	pop $r2
+	pop $r3
+	hlt
+`)
+	result.AssertRegister("r2", 7)
+	result.AssertRegister("r3", 0x1234)
+	result.AssertRegister("sp", emulator.StackTop)
+	result.AssertMemory(emulator.StackTop-4, []byte{0x00, 0x07, 0x12, 0x34})
+}
+
+func TestCallAndReturn(t *testing.T) {
+	result := chiptest.Run(t, `
+	mov $r1, #3
+	call .double
+	call .double
+	hlt
+.double
+	enter #2
+	str $r1, -1+$bp
+	ldr $r2, -1+$bp
+	add $r1, $r2
+	leave
+	ret
+`)
+	result.AssertRegister("r1", 12)
+	result.AssertRegister("sp", emulator.StackTop)
+	result.AssertRegister("bp", emulator.StackTop)
+}
+
+func TestStackFaults(t *testing.T) {
+	overflow := chiptest.Run(t, `
+.loop
+	push #1
+	jmp .loop
+`)
+	overflow.AssertFault(emulator.ErrStackOverflow)
+	overflow.AssertPc(0)
+
+	underflow := chiptest.Run(t, `
+	pop $r1
+`)
+	underflow.AssertFault(emulator.ErrStackUnderflow)
+}
+
+func TestMemoryFaults(t *testing.T) {
+	unmapped := chiptest.Run(t, `
+	ldr $r1, [0xFFFF]
+`)
+	unmapped.AssertFault(emulator.ErrUnmappedAddress)
+
+	protected := chiptest.RunWithOptions(t, `
+	str $r1, [.self]
+.self
+	hlt
+`, chiptest.Options{Protect: true})
+	protected.AssertFault(emulator.ErrWriteProtected)
+	protected.AssertPc(0)
+}
+
+func TestConsole(t *testing.T) {
+	result := chiptest.RunWithOptions(t, `
+.equ CONSOLE, 0xF000
+.next
+	ldr $r1, [CONSOLE+1]
+	and $r1, #2
+	jne .done
+	ldr $r1, [CONSOLE]
+	add $r1, #1
+	str $r1, [CONSOLE]
+	jmp .next
+.done
+	hlt
+`, chiptest.Options{Input: "HAL"})
+	result.AssertConsole("IBM")
+}
+
+func TestTimerInterrupt(t *testing.T) {
+	result := chiptest.Run(t, `
+.equ TIMER, 0xF010
+.equ IRQ, 0xF030
+	mov $r1, .tick
+	stw $r1, [IRQ+2]
+	mov $r1, #1
+	str $r1, [IRQ]
+	mov $r1, #100
+	str $r1, [TIMER+1]
+	mov $r1, #3
+	str $r1, [TIMER+2]
+	ei
+.wait
+	cmp $r3, #4
+	jb .wait
+	di
+	hlt
+.tick
+	add $r3, #1
+	iret
+`)
+	result.AssertRegister("r3", 4)
+	result.AssertRegister("sp", emulator.StackTop)
+	if result.Chip.InterruptsEnabled {
+		t.Error("interrupts are still enabled")
+	}
+}
+
+func TestInterruptsStartDisabled(t *testing.T) {
+	result := chiptest.Run(t, `
+.equ TIMER, 0xF010
+.equ IRQ, 0xF030
+	mov $r1, #1
+	str $r1, [IRQ]
+	str $r1, [TIMER+1]
+	str $r1, [TIMER+2]
+	add $r2, #1
+	add $r2, #1
+	ldr $r3, [IRQ+1]
+	hlt
+`)
+	result.AssertRegister("r2", 2)
+	result.AssertRegister("r3", 1)
+}
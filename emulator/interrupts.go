@@ -0,0 +1,135 @@
+package emulator
+
+/**
+Interrupts:
+	- Devices raise interrupts on one of 8 lines of the interrupt controller, lower lines take priority
+	- The controller is a device (InterruptBase, 18 bytes) with the registers:
+		+0  ENABLE   bit n enables line n
+		+1  PENDING  bit n is set while line n is waiting to be serviced, writing a 1 to a bit clears it
+		+2  VECTORS  8 big endian 16 bit handler addresses, one for each line
+	- Before each instruction, if interrupts are enabled (EI) and an enabled line is pending, the CPU pushes
+	  Pc then Vf, disables interrupts, clears the pending bit and jumps to the line's handler, this takes
+	  the place of executing an instruction
+	- IRET pops Vf then Pc and enables interrupts again, DI disables them
+	- Interrupts start disabled
+*/
+
+const InterruptBase uint16 = 0xF030
+
+// interrupt lines of the standard devices
+const (
+	IRQTimer   = 0
+	IRQConsole = 1
+)
+
+const numInterruptLines = 8
+
+// InterruptController collects interrupts raised by devices until the CPU services them
+type InterruptController struct {
+	Enabled uint8
+	Pending uint8
+	Vectors [numInterruptLines]uint16
+}
+
+// Raise marks a line as waiting to be serviced
+func (i *InterruptController) Raise(line int) {
+	i.Pending |= 1 << line
+}
+
+// next returns the highest priority line that is both pending and enabled
+func (i *InterruptController) next() (int, bool) {
+	waiting := i.Pending & i.Enabled
+	for line := 0; line < numInterruptLines; line++ {
+		if waiting&(1<<line) != 0 {
+			return line, true
+		}
+	}
+	return 0, false
+}
+
+func (i *InterruptController) Size() int { return 2 + 2*numInterruptLines }
+
+func (i *InterruptController) Read(offset uint16) (uint8, error) {
+	switch offset {
+	case 0:
+		return i.Enabled, nil
+	case 1:
+		return i.Pending, nil
+	}
+
+	vector := i.Vectors[(offset-2)/2]
+	if offset%2 == 0 {
+		return uint8(vector >> 8), nil
+	}
+	return uint8(vector), nil
+}
+
+func (i *InterruptController) Write(offset uint16, value uint8) error {
+	switch offset {
+	case 0:
+		i.Enabled = value
+		return nil
+	case 1:
+		i.Pending &^= value
+		return nil
+	}
+
+	vector := &i.Vectors[(offset-2)/2]
+	if offset%2 == 0 {
+		*vector = uint16(value)<<8 | *vector&0xFF
+	} else {
+		*vector = *vector&0xFF00 | uint16(value)
+	}
+	return nil
+}
+
+// SaveState stores the controller's registers in the same layout they are mapped in
+func (i *InterruptController) SaveState() []uint8 {
+	state := make([]uint8, i.Size())
+	for offset := range state {
+		state[offset], _ = i.Read(uint16(offset))
+	}
+	return state
+}
+
+func (i *InterruptController) DecodeState(state []uint8) (func(), error) {
+	if len(state) != i.Size() {
+		return nil, ErrDeviceState
+	}
+	return func() {
+		i.Enabled, i.Pending = state[0], state[1]
+		for offset := 2; offset < len(state); offset++ {
+			i.Write(uint16(offset), state[offset])
+		}
+	}, nil
+}
+
+// serviceInterrupt enters the handler of the highest priority pending interrupt, if there
+// is one and interrupts are enabled, it returns true if an interrupt was serviced
+func (c *Chipster) serviceInterrupt() bool {
+	if c.Interrupts == nil || !c.InterruptsEnabled {
+		return false
+	}
+	line, ok := c.Interrupts.next()
+	if !ok {
+		return false
+	}
+
+	if err := c.push(c.Pc); err != nil {
+		c.fault(err, c.Pc)
+		return true
+	}
+	if err := c.push(c.Vf); err != nil {
+		c.fault(err, c.Pc)
+		return true
+	}
+
+	if c.trace != nil {
+		c.trace.Interrupt = &line
+	}
+	c.InterruptsEnabled = false
+	c.Interrupts.Pending &^= 1 << line
+	c.Pc = c.Interrupts.Vectors[line]
+	c.Cycles += InterruptCycles
+	return true
+}
@@ -1,7 +1,9 @@
 package emulator
 
 import (
+	"cheepcheep/isa"
 	"fmt"
+	"io"
 	"os"
 )
 
@@ -10,38 +12,85 @@ Implementation Details:
 	- The program to compute is located in memory from 0x0 onwards
 	- Memory grows from there
 
-	- The CPU can address 4k bytes of memory
-	- There are 16 registers most are 8 bits except:
-		- The stack pointer
-		- The stack base pointer
-		- Which are 16 bits long
-		- The register codes are r14 and r15 respectively
+	- The CPU can address the full 64k of memory through its bus, see bus.go for the memory map
+	  and stack.go for the stack
+	- There are 16 registers, all 16 bits wide:
+		- The zero register (code 0) which always reads as 0
+		- 13 general purpose registers
+		- The stack pointer and the stack base pointer, the register codes are 14 and 15 respectively (see the isa package)
+	- ALU operations work on all 16 bits, LDR and STR move a single byte to and from memory (zero extending
+	  loads) while LDW and STW move a 16 bit big endian word
 */
 
 // defines the internal state of the Chip8
 type Chipster struct {
 
 	// Defines the basic entries in the emulator, memory related
-	Memory         [4096]uint8
-	Registers      [14]uint8
+	Bus            Bus
+	Registers      [14]uint16
 	StackRegisters [2]uint16
 
 	// Control flow variables
 	Pc uint16 // program counter
 
-	// Of special importance in the VF flag are the first least significant two bits
-	// LSB: if last operation was 0, LSB 2.0: if last operation resulted in a negative number
-	// the 3rd LSB indicates an attempted division by zero
+	// Vf holds the Z, N, C, V and D flags set by the ALU, see flags.go for the bits and when each is set
 	Vf uint16 // flag register
 
+	// Interrupts is the controller the CPU takes interrupts from, it may be nil if
+	// nothing can raise interrupts, InterruptsEnabled is toggled by EI and DI
+	Interrupts        *InterruptController
+	InterruptsEnabled bool
+
+	// Output is where PRINT writes to, standard out if it is nil
+	Output io.Writer
+
+	// Cycles counts the clock cycles taken so far and ClockSpeed, if it is set, is the
+	// number of cycles per second Run executes at (see timing.go), CycleLimit, if it is
+	// set, stops Run once Cycles reaches it
+	Cycles     uint64
+	ClockSpeed uint64
+	CycleLimit uint64
+
+	// Tracer records every step the chip takes if it is set (see trace.go), trace is the step
+	// currently being recorded and steps counts the steps taken so far
+	Tracer Tracer
+	trace  *TraceStep
+	steps  uint64
+
+	// history remembers how to undo the most recent steps if it is enabled (see history.go), undo
+	// is the record of the step currently being taken
+	history *history
+	undo    *undoRecord
+
+	// Halted is set once the chip executes a HLT instruction or faults, in which
+	// case Fault holds the *Fault (see faults.go) and Pc is left on the faulting instruction
+	Halted bool
+	Fault  error
 }
 
-// NewChip builds and returns a new chip
+// NewChip builds and returns a new chip with the default memory map
 func NewChip() Chipster {
+	return NewChipWithBus(StandardMemoryMap(0))
+}
+
+// NewChipWithDevices builds a chip with the default memory map and the standard devices attached,
+// the first romSize bytes of memory are mapped as ROM (see StandardMemoryMap)
+func NewChipWithDevices(romSize int, devices Devices) (Chipster, error) {
+	memory := StandardMemoryMap(romSize)
+	if err := devices.Attach(memory); err != nil {
+		return Chipster{}, err
+	}
+	chip := NewChipWithBus(memory)
+	chip.Interrupts = devices.Interrupts
+	return chip, nil
+}
+
+// NewChipWithBus builds and returns a new chip connected to the given bus
+func NewChipWithBus(bus Bus) Chipster {
 	return Chipster{
-		Memory:         [4096]uint8{0},
-		Registers:      [14]uint8{0},
-		StackRegisters: [2]uint16{0},
+		Bus:            bus,
+		Registers:      [14]uint16{0},
+		StackRegisters: [2]uint16{StackTop, StackTop},
 
 		Pc: 0,
 		Vf: 0,
@@ -50,255 +99,356 @@ func NewChip() Chipster {
 
 // LoadROM opens a file from the OS and reads it into memory
 // note: it is assumed that the source file is simply a compiled file
-func (c *Chipster) LoadROM(sourceFile string) {
+func (c *Chipster) LoadROM(sourceFile string) error {
+	buffer, err := os.ReadFile(sourceFile)
+	if err != nil {
+		return err
+	}
 
-	file, err := os.OpenFile(sourceFile, os.O_RDONLY, 0777)
-	// TODO: fix this later
+	// finally copy the bytecode buffer into the chip, if the bus can't load data
+	// directly the ROM is written a byte at a time
+	if loader, ok := c.Bus.(interface{ Load(uint16, []uint8) error }); ok {
+		err = loader.Load(0, buffer)
+	} else {
+		for address, value := range buffer {
+			if err = c.Bus.Write(uint16(address), value); err != nil {
+				break
+			}
+		}
+	}
 	if err != nil {
-		panic(err)
+		return fmt.Errorf("ROM %s (%d bytes) does not fit in memory: %w", sourceFile, len(buffer), err)
+	}
+	return nil
+}
+
+// ReadRegister reads the register with the given isa index, the zero register always reads as 0
+// and the final two indices refer to the stack registers
+func (c *Chipster) ReadRegister(register uint8) uint16 {
+	switch {
+	case register == isa.ZERO:
+		return 0
+	case register >= isa.SP:
+		return c.StackRegisters[register-isa.SP]
+	default:
+		return c.Registers[register]
+	}
+}
+
+// writeRegister writes to the register with the given isa index, writes to the zero register are discarded
+func (c *Chipster) writeRegister(register uint8, value uint16) {
+	if c.undo != nil && register != isa.ZERO {
+		c.undo.registers = append(c.undo.registers, RegisterWrite{register, c.ReadRegister(register)})
 	}
-	defer file.Close()
 
-	// read the file into a bytecode buffer
-	fileSize, _ := file.Stat()
-	buffer := make([]byte, fileSize.Size())
-	file.Read(buffer)
+	switch {
+	case register == isa.ZERO:
+		return
+	case register >= isa.SP:
+		c.StackRegisters[register-isa.SP] = value
+	default:
+		c.Registers[register] = value
+	}
 
-	// finally copy the bytecode buffer into the chip
-	copy(c.Memory[:], buffer)
+	if c.trace != nil {
+		c.trace.Registers = append(c.trace.Registers, RegisterWrite{register, value})
+	}
+}
 
+// effectiveAddress determines the address an instruction's flexible operand refers to, for immediate
+// and register modes the operand itself is the address (this is what jumps use)
+// origin is the address of the instruction being executed
+func (c *Chipster) effectiveAddress(instruction isa.Instruction, origin uint16) uint16 {
+	switch instruction.Mode {
+	case isa.Register:
+		return c.ReadRegister(instruction.Base)
+	case isa.RegisterRelative:
+		return c.ReadRegister(instruction.Base) + instruction.Value
+	case isa.PCRelative:
+		return origin + instruction.Value
+	default:
+		return instruction.Value
+	}
 }
 
-// TODO: fix up addressing mode logic
+// computeOperand determines what value should be inputted into the operation, immediate and register
+// operands are used as is while the relative modes fetch the operand from memory, a byte unless wide is set
+// in which case it is a big endian word
+func (c *Chipster) computeOperand(instruction isa.Instruction, origin uint16, wide bool) (uint16, error) {
+	switch instruction.Mode {
+	case isa.Immediate:
+		return instruction.Value, nil
+	case isa.Register:
+		return c.ReadRegister(instruction.Base), nil
+	}
 
-// computeOperand determines what values should be inputted into the operation, note its only called by functions
-// that support multiple addressing modes, additionally; depending on the function, the amount of desired "bytes" in the
-// operand is provided: eg. if the operand is expected to be an address (like jump commands) then it requests 2 bytes
-// along with the value we just computed we return how many bytes were "used" to get that value from the code segment
-func (c *Chipster) computeOperand(addrMode uint8, requestedBytes uint16) (uint16, uint16) {
+	address := c.effectiveAddress(instruction, origin)
+	high, err := c.Bus.Read(address)
+	if err != nil || !wide {
+		return uint16(high), err
+	}
+	low, err := c.Bus.Read(address + 1)
+	return uint16(high)<<8 | uint16(low), err
+}
 
-	// First compute the physical location in memory specified by the addressing mode, if we are accessing a register
-	// just flick its flag
-	var memoryLocation uint16 = c.Pc
-	var usedBytes uint16 = requestedBytes
-	var isRegisterAccess bool = false
+// decode decodes an instruction, checking that it can be executed
+func decode(encoded [isa.InstructionSize]byte) (isa.Instruction, error) {
+	instruction, err := isa.Decode(encoded)
+	if err != nil {
+		return instruction, fmt.Errorf("%w 0x%02x", ErrIllegalOpcode, uint8(instruction.Opcode))
+	}
 
-	switch addrMode {
-	case immediate:
-		break
-	case direct:
-		memoryLocation = uint16(c.Memory[c.Pc])<<8 | uint16(c.Memory[c.Pc+1])
-		usedBytes = 2
-		break
-	case indirect:
-		baseLocation := uint16(c.Memory[c.Pc])<<8 | uint16(c.Memory[c.Pc+1])
-		memoryLocation = uint16(c.Memory[baseLocation])<<8 | uint16(c.Memory[baseLocation+1])
-		usedBytes = 2
-		break
-	case registerDirect:
-		memoryLocation = uint16(c.Memory[c.Pc])
-		isRegisterAccess = true
-		break
+	info := isa.OPCODES[instruction.Opcode]
+	if len(info.Operands) == 0 || info.Operands[len(info.Operands)-1] != isa.FlexibleOperand {
+		if instruction.Mode != isa.Immediate {
+			return instruction, fmt.Errorf("%w %d, %s has no flexible operand", ErrIllegalAddressingMode, instruction.Mode, info.Mnemonic)
+		}
 	}
+	return instruction, nil
+}
 
-	// Now resolve and compute the operand data
-	if isRegisterAccess {
-		return uint16(c.Registers[memoryLocation]), usedBytes
-	} else {
-		// 2 possible situations: if the requested bytes was a single value or if the requested byte was 2 bytes
-		// 2 bytes implies we read the next two values, otherwise we read a single value
-		var highByte uint8 = 0
-		var lowByte uint8 = c.Memory[c.Pc]
-		if requestedBytes == 2 {
-			highByte = c.Memory[c.Pc]
-			lowByte = c.Memory[c.Pc+1]
+// fetch reads the encoded instruction at address
+func (c *Chipster) fetch(address uint16) ([isa.InstructionSize]byte, error) {
+	var encoded [isa.InstructionSize]byte
+	for i := range encoded {
+		value, err := c.Bus.Read(address + uint16(i))
+		if err != nil {
+			return encoded, err
 		}
+		encoded[i] = value
+	}
+	return encoded, nil
+}
 
-		return uint16(highByte)<<8 | uint16(lowByte), usedBytes
+// PerformNextComputation reads the current instruction from memory and performs the dictated instruction, once
+// the chip halts or faults it returns a *Fault describing why (see faults.go) and stops executing instructions
+func (c *Chipster) PerformNextComputation() error {
+	if c.Halted {
+		return c.stopReason()
 	}
+	c.step()
+	if c.Halted {
+		return c.stopReason()
+	}
+	return nil
 }
 
-// PerformNextComputation reads the current instruction from memory and performs the dictated instruction
-func (c *Chipster) PerformNextComputation() {
+// step takes a single step, either entering an interrupt handler or executing an instruction
+func (c *Chipster) step() {
+	// devices that keep time advance once per cycle the step takes
+	defer c.tick(c.Cycles)
+	c.beginTrace()
+	defer c.endTrace()
+	c.beginUndo()
+	defer c.endUndo()
+
+	// entering an interrupt handler takes the place of an instruction
+	if c.serviceInterrupt() {
+		return
+	}
+
+	// fetch and decode the current instruction
+	encoded, err := c.fetch(c.Pc)
+	if err != nil {
+		c.fault(err, c.Pc)
+		return
+	}
+	instruction, err := decode(encoded)
+	if err != nil {
+		c.fault(err, c.Pc)
+		return
+	}
 
-	// extract the current instruction, opcode and the addressing mode
-	var currentInstruction uint8 = c.Memory[c.Pc]
-	var opcode uint8 = (currentInstruction & (0xf8)) >> 3
-	var addrMode uint8 = currentInstruction & 0x7
-	c.Pc += 1
+	origin := c.Pc
+	targetRegister := instruction.Reg
+	c.Pc += isa.InstructionSize
+	c.Cycles += CycleCost(instruction)
+
+	// fetch the value of the flexible operand up front, addressed operands (jumps and stores)
+	// use the effective address instead
+	var operand uint16
+	if info := isa.OPCODES[instruction.Opcode]; len(info.Operands) != 0 && !info.Addressed {
+		if operand, err = c.computeOperand(instruction, origin, instruction.Opcode == isa.LDW); err != nil {
+			c.fault(err, origin)
+			return
+		}
+	}
+	if c.trace != nil {
+		c.trace.Instruction, c.trace.Operand = instruction.String(), operand
+		if isa.OPCODES[instruction.Opcode].Addressed {
+			c.trace.Operand = c.effectiveAddress(instruction, origin)
+		}
+	}
 
-	switch {
+	switch opcode := instruction.Opcode; {
 
-	case opcode == PRINT:
-		// Fetch the next byte from memory
-		var targetRegister uint8 = c.Memory[c.Pc]
-		c.Pc += 1
-		fmt.Printf("Outputted: %d\n", c.Registers[targetRegister])
+	case opcode == isa.PRINT:
+		output := c.Output
+		if output == nil {
+			output = os.Stdout
+		}
+		fmt.Fprintf(output, "Outputted: %d\n", c.ReadRegister(targetRegister))
 		break
 
 	// memory storage routines
-	case opcode == LDR:
-		// fetch the target register
-		var targetRegister uint8 = c.Memory[c.Pc]
-		c.Pc += 1
-
-		// fetch the operand and increment the program counter
-		loadValue, usedBytes := c.computeOperand(addrMode, 1)
-		c.Registers[targetRegister] = uint8(loadValue)
-		c.Pc += usedBytes
+	case opcode == isa.MOV, opcode == isa.LDR, opcode == isa.LDW:
+		c.writeRegister(targetRegister, operand)
 		break
-	case opcode == STR:
-		// do the usual fetching of the target register
-		var targetRegister uint8 = c.Memory[c.Pc]
-		c.Pc += 1
-
-		// fetch the operand and increment the program counter
-		locationToStore, usedBytes := c.computeOperand(addrMode, 2)
-		c.Memory[locationToStore] = c.Registers[targetRegister]
-		c.Pc += usedBytes
+	case opcode == isa.STR:
+		locationToStore := c.effectiveAddress(instruction, origin)
+		if err := c.write(locationToStore, uint8(c.ReadRegister(targetRegister))); err != nil {
+			c.fault(err, origin)
+		}
+		break
+	case opcode == isa.STW:
+		// words are stored big endian like instructions
+		locationToStore := c.effectiveAddress(instruction, origin)
+		value := c.ReadRegister(targetRegister)
+		if err := c.write(locationToStore, uint8(value>>8)); err != nil {
+			c.fault(err, origin)
+			return
+		}
+		if err := c.write(locationToStore+1, uint8(value)); err != nil {
+			c.fault(err, origin)
+		}
 		break
 
 	// if the operation is of the form:
-	// 01xxx then it is an alu operation
+	// 001xxx then it is an alu operation
 	// ALU operations
-	case (opcode&ALU)>>3 == 1:
+	case opcode.IsALU():
 		// fetch the operand data
-		var targetRegister uint8 = c.Memory[c.Pc]
-		c.Pc += 1
-		op, usedBytes := c.computeOperand(addrMode, 1)
-		operandVal := uint8(op)
-		c.Pc += usedBytes
-
-		// decode the ALU operation and perform the appropriate instruction
-		var aluOp uint8 = opcode & 0x7
-		switch aluOp {
-		case ADD:
-			c.Registers[targetRegister] += operandVal
+		operandVal := operand
+		registerVal := c.ReadRegister(targetRegister)
+
+		// decode the ALU operation and perform the appropriate instruction, every operation
+		// sets the flags from its result (see flags.go)
+		var carry, overflow, divideByZero bool
+		switch opcode {
+		case isa.ADD:
+			registerVal, carry, overflow = add(registerVal, operandVal)
 			break
-		case SUB:
-			var willBeNegative bool = (c.Registers[targetRegister] - operandVal) < 0
-			c.Registers[targetRegister] -= operandVal
-
-			// set the appropriate flags
-			if willBeNegative {
-				c.Vf &= 0xfffc // unset the last two bits in the flag register
-				c.Vf |= 0x2    // set last two bits to 10
-			}
+		case isa.SUB:
+			registerVal, carry, overflow = subtract(registerVal, operandVal)
 			break
-		case MUL:
-			c.Registers[targetRegister] *= operandVal
+		case isa.MUL:
+			product := uint32(registerVal) * uint32(operandVal)
+			registerVal = uint16(product)
+			carry, overflow = product > 0xFFFF, product > 0xFFFF
 			break
-		case DIV:
+		case isa.DIV:
 			if operandVal != 0 {
-				c.Registers[targetRegister] /= operandVal
+				registerVal /= operandVal
 			} else {
-				c.Vf &= 0xfffb // unset the 3rd last bit in the flag register
-				c.Vf |= 0x4    // set the 3rd last bit to 1
+				divideByZero = true
 			}
 			break
-		case XOR:
-			c.Registers[targetRegister] ^= operandVal
+		case isa.XOR:
+			registerVal ^= operandVal
 			break
-		case AND:
-			c.Registers[targetRegister] &= operandVal
+		case isa.AND:
+			registerVal &= operandVal
 			break
-		case OR:
-			c.Registers[targetRegister] |= operandVal
+		case isa.OR:
+			registerVal |= operandVal
 			break
-		case NOT:
-			c.Registers[targetRegister] = operandVal
+		case isa.NOT:
+			registerVal = ^operandVal
 			break
 		}
+		c.writeRegister(targetRegister, registerVal)
+		c.setFlags(registerVal, carry, overflow, divideByZero)
+
+	// the compare operation subtracts the operand from the target register, setting the flags
+	// from the result without storing it
+	case opcode == isa.CMP:
+		result, borrow, overflow := subtract(c.ReadRegister(targetRegister), operand)
+		c.setFlags(result, borrow, overflow, false)
+		break
 
-	// the compare operation compares a operand and a target register, modifying the flag register
-	// accordingly
-	case opcode == CMP:
-		// fetch the target register
-		var targetRegister uint8 = c.Memory[c.Pc]
-		c.Pc += 1
-
-		// fetch the operand and increment the program counter
-		valueToCompare, usedBytes := c.computeOperand(addrMode, 1)
-		c.Pc += usedBytes
-
-		// compare the two values and based on the result of the comparison, set the corresponding flag register
-		var comparison int8 = int8(c.Registers[targetRegister]) - int8(valueToCompare)
-		c.Vf &= 0xfffc // unset the last two bits in the flag register
-		switch {
-		case comparison == 0:
-			c.Vf |= 0x1 // set the last two bits to the appropriate value, in this case 01
-			break
-		case comparison < 0:
-			c.Vf |= 0x2 // set last two bits to 10
-			break
-		case comparison > 0:
-			// do nothing :)
-			break
+	// the following contains the set of jump instructions, conditional jumps are only taken
+	// if the flags match their condition
+	case opcode == isa.JMP:
+		c.Pc = c.effectiveAddress(instruction, origin)
+		break
+	case opcode.IsConditionalJump():
+		if c.conditionMet(opcode) {
+			c.Pc = c.effectiveAddress(instruction, origin)
 		}
 		break
 
-	// the following contains the set of jump instructions
-	// this is an awful messy implementation
-	case opcode == JMPL:
-		// Read from the flag registers, since its JMPL the final two bits should read: 10
-		var flagRegister uint16 = c.Vf & 0x3
-		jumpDestination, consumedBytes := c.computeOperand(addrMode, 2)
-		c.Pc += consumedBytes
-
-		if flagRegister == 0x2 {
-			// Perform the jump to the requested location
-			// we shouldn't increment the bytes we consumed during a jump instruction
-			c.Pc = jumpDestination
+	// stack operations, every value on the stack is 16 bits wide
+	case opcode == isa.PUSH:
+		if err := c.push(operand); err != nil {
+			c.fault(err, origin)
+		}
+	case opcode == isa.POP:
+		value, err := c.pop()
+		if err != nil {
+			c.fault(err, origin)
 			return
 		}
-		break
-	case opcode == JMPG:
-		// Read from the flag registers, since its JMPG the final two bits should read: 00
-		var flagRegister uint16 = c.Vf & 0x3
-		jumpDestination, consumedBytes := c.computeOperand(addrMode, 2)
-		c.Pc += consumedBytes
-
-		if flagRegister == 0x0 {
-			// Perform the jump to the requested location
-			// we shouldn't increment the bytes we consumed during a jump instruction
-			c.Pc = jumpDestination
+		c.writeRegister(targetRegister, value)
+	case opcode == isa.CALL:
+		// the return address is the instruction following the call
+		if err := c.push(c.Pc); err != nil {
+			c.fault(err, origin)
 			return
 		}
-		break
-	case opcode == JMP:
-		jumpDestination, _ := c.computeOperand(addrMode, 2)
-		c.Pc = jumpDestination
-		break
-	case opcode == JMPLE:
-		// Read from the flag registers, since its JMPLE the final two bits should read: 11
-		var flagRegister uint16 = c.Vf & 0x3
-		jumpDestination, consumedBytes := c.computeOperand(addrMode, 2)
-		c.Pc += consumedBytes
-
-		if flagRegister == 0x3 {
-			// Perform the jump to the requested location
-			// we shouldn't increment the bytes we consumed during a jump instruction
-			c.Pc = jumpDestination
+		c.Pc = c.effectiveAddress(instruction, origin)
+	case opcode == isa.RET:
+		returnAddress, err := c.pop()
+		if err != nil {
+			c.fault(err, origin)
 			return
 		}
-		break
-	case opcode == JMPGE:
-		// Read from the flag registers, since its JMPGE the final two bits should read: 01
-		var flagRegister uint16 = c.Vf & 0x3
-		jumpDestination, consumedBytes := c.computeOperand(addrMode, 2)
-		c.Pc += consumedBytes
-
-		if flagRegister == 0x1 {
-			// Perform the jump to the requested location
-			// we shouldn't increment the bytes we consumed during a jump instruction
-			c.Pc = jumpDestination
+		c.Pc = returnAddress
+	case opcode == isa.ENTER:
+		// save the caller's frame and then reserve room for locals below it
+		if err := c.push(c.ReadRegister(isa.BP)); err != nil {
+			c.fault(err, origin)
 			return
 		}
-		break
+		sp := c.ReadRegister(isa.SP)
+		size := operand
+		if size > sp-StackLimit {
+			c.fault(ErrStackOverflow, origin)
+			return
+		}
+		c.writeRegister(isa.BP, sp)
+		c.writeRegister(isa.SP, sp-size)
+	case opcode == isa.LEAVE:
+		c.writeRegister(isa.SP, c.ReadRegister(isa.BP))
+		bp, err := c.pop()
+		if err != nil {
+			c.fault(err, origin)
+			return
+		}
+		c.writeRegister(isa.BP, bp)
+
+	// interrupt control
+	case opcode == isa.EI:
+		c.InterruptsEnabled = true
+	case opcode == isa.DI:
+		c.InterruptsEnabled = false
+	case opcode == isa.IRET:
+		flags, err := c.pop()
+		if err != nil {
+			c.fault(err, origin)
+			return
+		}
+		returnAddress, err := c.pop()
+		if err != nil {
+			c.fault(err, origin)
+			return
+		}
+		c.Vf, c.Pc = flags, returnAddress
+		c.InterruptsEnabled = true
 
-	case opcode == HLT:
-		//fmt.Printf("Unidentified opcode: %08b\n", opcode)
-		c.Pc -= 1
+	case opcode == isa.HLT:
+		// halting simply parks the program counter on the HLT instruction
+		c.Pc = origin
+		c.Halted = true
 		return
 	}
 }
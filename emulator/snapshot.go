@@ -0,0 +1,287 @@
+package emulator
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"strconv"
+	"strings"
+)
+
+/*
+	Snapshots save the whole state of a chip so a run can be stopped and resumed later, they are stored
+	as plain text, a header line followed by one record per line and finally a checksum:
+		CHIPSNAP 2
+		CPU <pc> <vf> <interrupts enabled> <halted> <steps> <cycles>
+		FAULT <kind> <pc> <quoted reason>
+		REGISTERS <the 14 registers> <sp> <bp>
+		RAM <start> <size>
+		ROM <start> <size>
+		DATA <address> <hex bytes>
+		DEVICE <start> <size> <hex state>
+		CHECKSUM <crc32 of every line before it, in hex>
+	FAULT is only written if the chip faulted (see faults.go). RAM and ROM records describe the memory layout, their contents
+	are written as DATA records of up to 32 bytes with runs of zeroes left out. There's a DEVICE record for every
+	device on the bus, the state is empty unless the device is Stateful (see devices.go).
+
+	Restoring a snapshot replaces the chip's RAM and ROM with the snapshot's, the devices stay attached but must
+	sit where the snapshot says they do. The undo history (see history.go) isn't saved and neither is the console's
+	input, a restored chip reads whatever input its console is given.
+*/
+
+const (
+	snapshotHeader  = "CHIPSNAP"
+	snapshotVersion = 2
+
+	// dataWidth is the number of bytes in each DATA record
+	dataWidth = 32
+)
+
+// ErrSnapshotChecksum is returned when restoring a snapshot that has been modified or cut short
+var ErrSnapshotChecksum = errors.New("snapshot checksum does not match its contents")
+
+// Snapshot writes the state of the chip to w, the chip must be connected to a MemoryMap
+func (c *Chipster) Snapshot(w io.Writer) error {
+	memory, ok := c.Bus.(*MemoryMap)
+	if !ok {
+		return fmt.Errorf("cannot snapshot a chip that isn't connected to a memory map")
+	}
+
+	var body bytes.Buffer
+	fmt.Fprintf(&body, "%s %d\n", snapshotHeader, snapshotVersion)
+	fmt.Fprintf(&body, "CPU %d %d %d %d %d %d\n", c.Pc, c.Vf, boolToInt(c.InterruptsEnabled), boolToInt(c.Halted), c.steps, c.Cycles)
+	if c.Fault != nil {
+		fmt.Fprintf(&body, "FAULT %s\n", describeFault(c.Fault))
+	}
+	fmt.Fprint(&body, "REGISTERS")
+	for _, value := range append(c.Registers[:], c.StackRegisters[:]...) {
+		fmt.Fprintf(&body, " %d", value)
+	}
+	fmt.Fprintln(&body)
+
+	for _, mapping := range memory.mappings {
+		switch region := mapping.region.(type) {
+		case RAM:
+			fmt.Fprintf(&body, "RAM %d %d\n", mapping.start, len(region))
+			writeData(&body, mapping.start, region)
+		case ROM:
+			fmt.Fprintf(&body, "ROM %d %d\n", mapping.start, len(region))
+			writeData(&body, mapping.start, region)
+		default:
+			var state []uint8
+			if stateful, ok := region.(Stateful); ok {
+				state = stateful.SaveState()
+			}
+			fmt.Fprintf(&body, "DEVICE %d %d %s\n", mapping.start, region.Size(), hex.EncodeToString(state))
+		}
+	}
+
+	fmt.Fprintf(&body, "CHECKSUM %08x\n", crc32.ChecksumIEEE(body.Bytes()))
+	_, err := body.WriteTo(w)
+	return err
+}
+
+// writeData writes the contents of a block of memory as DATA records, skipping any records that would be all zeroes
+func writeData(w io.Writer, start uint16, data []uint8) {
+	for offset := 0; offset < len(data); offset += dataWidth {
+		chunk := data[offset:min(offset+dataWidth, len(data))]
+		if bytes.Count(chunk, []byte{0}) != len(chunk) {
+			fmt.Fprintf(w, "DATA %d %s\n", int(start)+offset, hex.EncodeToString(chunk))
+		}
+	}
+}
+
+// Restore reads a snapshot written by Snapshot and puts the chip back into the state it describes, the
+// chip must be connected to a memory map with the same devices attached as the chip the snapshot was
+// taken of, if the snapshot can't be restored the chip is left untouched
+func (c *Chipster) Restore(r io.Reader) error {
+	memory, ok := c.Bus.(*MemoryMap)
+	if !ok {
+		return fmt.Errorf("cannot restore a chip that isn't connected to a memory map")
+	}
+
+	contents, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	body, err := verifyChecksum(contents)
+	if err != nil {
+		return err
+	}
+
+	// everything is restored onto a copy first so a bad snapshot doesn't leave the chip half restored
+	restored := *c
+	restoredMemory := NewMemoryMap()
+	restores := []func(){}
+
+	scanner := bufio.NewScanner(bytes.NewReader(body))
+	scanner.Scan()
+	if fields := strings.Fields(scanner.Text()); len(fields) != 2 || fields[0] != snapshotHeader || fields[1] != strconv.Itoa(snapshotVersion) {
+		return fmt.Errorf("line 1: not a version %d chip snapshot", snapshotVersion)
+	}
+	restored.Fault = nil
+	seen := map[string]bool{}
+
+	for line := 2; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+
+		var err error
+		switch {
+		case fields[0] == "CPU" && len(fields) == 7:
+			var enabled, halted int
+			_, err = fmt.Sscan(strings.Join(fields[1:], " "), &restored.Pc, &restored.Vf, &enabled, &halted, &restored.steps, &restored.Cycles)
+			restored.InterruptsEnabled, restored.Halted = enabled != 0, halted != 0
+		case fields[0] == "FAULT" && len(fields) >= 4:
+			var fault *Fault
+			if fault, err = parseFault(strings.TrimPrefix(scanner.Text(), "FAULT ")); err == nil {
+				restored.Fault = fault
+			}
+		case fields[0] == "REGISTERS" && len(fields) == 17:
+			values := make([]uint16, 16)
+			for i := range values {
+				if _, err = fmt.Sscan(fields[i+1], &values[i]); err != nil {
+					break
+				}
+			}
+			copy(restored.Registers[:], values)
+			copy(restored.StackRegisters[:], values[len(restored.Registers):])
+		case (fields[0] == "RAM" || fields[0] == "ROM") && len(fields) == 3:
+			var start uint16
+			var size int
+			if _, err = fmt.Sscan(fields[1]+" "+fields[2], &start, &size); err != nil {
+				break
+			}
+			if size <= 0 || size > 0x10000 {
+				err = fmt.Errorf("invalid region size %d", size)
+			} else if fields[0] == "RAM" {
+				err = restoredMemory.Map(start, make(RAM, size))
+			} else {
+				err = restoredMemory.Map(start, make(ROM, size))
+			}
+		case fields[0] == "DATA" && len(fields) == 3:
+			var address uint16
+			var data []uint8
+			if _, err = fmt.Sscan(fields[1], &address); err != nil {
+				break
+			}
+			if data, err = hex.DecodeString(fields[2]); err != nil {
+				break
+			}
+			err = restoredMemory.Load(address, data)
+		case fields[0] == "DEVICE" && (len(fields) == 3 || len(fields) == 4):
+			err = restoreDevice(memory, restoredMemory, fields[1:], &restores)
+		default:
+			err = fmt.Errorf("unrecognised record %q", scanner.Text())
+		}
+
+		if err != nil {
+			return fmt.Errorf("line %d: %w", line, err)
+		}
+		seen[fields[0]] = true
+	}
+	if !seen["CPU"] || !seen["REGISTERS"] {
+		return fmt.Errorf("the snapshot is missing the CPU's state")
+	}
+	if countDevices(restoredMemory) != countDevices(memory) {
+		return fmt.Errorf("the snapshot was taken of a chip with different devices attached")
+	}
+
+	// the snapshot has been read in full and every device's state checked, nothing can fail
+	// from here on so the devices and the chip are updated together
+	for _, restore := range restores {
+		restore()
+	}
+	memory.mappings = restoredMemory.mappings
+	restored.Bus = memory
+	restored.history, restored.undo, restored.trace = nil, nil, nil
+	if c.history != nil {
+		restored.EnableHistory(len(c.history.records))
+	}
+	*c = restored
+	return nil
+}
+
+// restoreDevice checks a DEVICE record against the device attached to the chip, mapping the device into the
+// restored memory and decoding its state so it can be restored once the rest of the snapshot has been read
+func restoreDevice(memory *MemoryMap, restoredMemory *MemoryMap, fields []string, restores *[]func()) error {
+	var start uint16
+	var size int
+	if _, err := fmt.Sscan(fields[0]+" "+fields[1], &start, &size); err != nil {
+		return err
+	}
+
+	region, offset, found := memory.find(start)
+	if !found || offset != 0 || region.Size() != size {
+		return fmt.Errorf("the snapshot has a device of %d bytes at 0x%04x but the chip doesn't", size, start)
+	}
+	switch region.(type) {
+	case RAM, ROM:
+		return fmt.Errorf("the snapshot has a device of %d bytes at 0x%04x but the chip doesn't", size, start)
+	}
+
+	if len(fields) == 3 {
+		state, err := hex.DecodeString(fields[2])
+		if err != nil {
+			return err
+		}
+		stateful, ok := region.(Stateful)
+		if !ok {
+			return fmt.Errorf("the device at 0x%04x has no state to restore", start)
+		}
+		restore, err := stateful.DecodeState(state)
+		if err != nil {
+			return fmt.Errorf("device at 0x%04x: %w", start, err)
+		}
+		*restores = append(*restores, restore)
+	}
+	return restoredMemory.Map(start, region)
+}
+
+// verifyChecksum checks the CHECKSUM record at the end of a snapshot, returning the contents it covers
+func verifyChecksum(contents []byte) ([]byte, error) {
+	trimmed := bytes.TrimRight(contents, "\n")
+	end := bytes.LastIndexByte(trimmed, '\n') + 1
+	body, last := contents[:end], string(trimmed[end:])
+
+	if !strings.HasPrefix(last, "CHECKSUM ") {
+		return nil, ErrSnapshotChecksum
+	}
+	if expected, err := strconv.ParseUint(strings.TrimPrefix(last, "CHECKSUM "), 16, 32); err != nil || uint32(expected) != crc32.ChecksumIEEE(body) {
+		return nil, ErrSnapshotChecksum
+	}
+	return body, nil
+}
+
+// countDevices counts the regions of a memory map that are neither RAM nor ROM
+func countDevices(memory *MemoryMap) int {
+	count := 0
+	for _, mapping := range memory.mappings {
+		switch mapping.region.(type) {
+		case RAM, ROM:
+		default:
+			count++
+		}
+	}
+	return count
+}
+
+func boolToInt(value bool) int {
+	if value {
+		return 1
+	}
+	return 0
+}
+
+func min(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,198 @@
+package emulator_test
+
+import (
+	"bytes"
+	"cheepcheep/chiptest"
+	"cheepcheep/emulator"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"regexp"
+	"testing"
+)
+
+// snapshotProgram sums random bytes each time the timer fires, so resuming it relies on
+// the timer, the interrupt controller and the random number generator being restored, the
+// total is stored in RAM at TOTAL as the program is loaded as ROM
+const snapshotProgram = `
+.equ TOTAL, 0x1000
+.equ TIMER, 0xF010
+.equ RANDOM, 0xF020
+.equ IRQ, 0xF030
+	mov $r1, .tick
+	stw $r1, [IRQ+2]
+	mov $r1, #1
+	str $r1, [IRQ]
+	mov $r1, #100
+	str $r1, [TIMER+1]
+	mov $r1, #3
+	str $r1, [TIMER+2]
+	ei
+.wait
+	cmp $r3, #6
+	jb .wait
+	di
+	stw $r2, [TOTAL]
+	hlt
+.tick
+	ldr $r4, [RANDOM]
+	add $r2, $r4
+	add $r3, #1
+	iret
+`
+
+var snapshotOptions = chiptest.Options{Seed: 42, Protect: true}
+
+func TestSnapshotResume(t *testing.T) {
+	chip := chiptest.Load(t, snapshotProgram, snapshotOptions)
+	for i := 0; i < 100; i++ {
+		chip.PerformNextComputation()
+	}
+	var saved bytes.Buffer
+	if err := chip.Snapshot(&saved); err != nil {
+		t.Fatal(err)
+	}
+	snapshot := saved.Bytes()
+	for !chip.Halted {
+		chip.PerformNextComputation()
+	}
+
+	// the restored chip is seeded differently and has nothing loaded, everything comes from the snapshot
+	resumed, err := emulator.NewChipWithDevices(0, emulator.NewDevices(nil, nil, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := resumed.Restore(bytes.NewReader(snapshot)); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; !resumed.Halted && i < 10000; i++ {
+		resumed.PerformNextComputation()
+	}
+
+	if resumed.Registers != chip.Registers || resumed.StackRegisters != chip.StackRegisters ||
+		resumed.Pc != chip.Pc || resumed.Vf != chip.Vf || !resumed.Halted || resumed.Fault != nil {
+		t.Errorf("resumed chip stopped in a different state to the original")
+	}
+	// everything up to and including TOTAL
+	for address := 0; address < 0x1002; address++ {
+		want, _ := chip.Bus.Read(uint16(address))
+		got, _ := resumed.Bus.Read(uint16(address))
+		if got != want {
+			t.Errorf("memory at 0x%04x is %d after resuming, want %d", address, got, want)
+		}
+	}
+
+	// the ROM region of the original chip is restored as well
+	if resumed.Fault != nil || chip.Fault != nil {
+		t.Fatalf("chip faulted: %v %v", chip.Fault, resumed.Fault)
+	}
+	if err := resumed.Bus.Write(0, 0); !errors.Is(err, emulator.ErrWriteProtected) {
+		t.Errorf("writing to the restored ROM gave %v, want %v", err, emulator.ErrWriteProtected)
+	}
+}
+
+func TestSnapshotChecksum(t *testing.T) {
+	chip := chiptest.Load(t, snapshotProgram, snapshotOptions)
+	var saved bytes.Buffer
+	if err := chip.Snapshot(&saved); err != nil {
+		t.Fatal(err)
+	}
+
+	corrupted := bytes.Replace(saved.Bytes(), []byte("CPU 0"), []byte("CPU 8"), 1)
+	restored := chiptest.Load(t, "hlt", chiptest.Options{})
+	if err := restored.Restore(bytes.NewReader(corrupted)); !errors.Is(err, emulator.ErrSnapshotChecksum) {
+		t.Errorf("restoring a corrupted snapshot gave %v, want %v", err, emulator.ErrSnapshotChecksum)
+	}
+	if err := restored.Restore(bytes.NewReader(saved.Bytes()[:saved.Len()/2])); !errors.Is(err, emulator.ErrSnapshotChecksum) {
+		t.Errorf("restoring a truncated snapshot gave %v, want %v", err, emulator.ErrSnapshotChecksum)
+	}
+}
+
+func TestSnapshotDevicesMustMatch(t *testing.T) {
+	chip := chiptest.Load(t, snapshotProgram, snapshotOptions)
+	var saved bytes.Buffer
+	if err := chip.Snapshot(&saved); err != nil {
+		t.Fatal(err)
+	}
+
+	bare := emulator.NewChip()
+	bare.Pc = 0x100
+	if err := bare.Restore(&saved); err == nil {
+		t.Fatal("restored a snapshot with devices onto a chip without any")
+	}
+	if bare.Pc != 0x100 {
+		t.Errorf("a failed restore changed the chip")
+	}
+}
+
+func TestSnapshotFailedRestoreLeavesDevicesAlone(t *testing.T) {
+	chip := chiptest.Load(t, snapshotProgram, snapshotOptions)
+	for i := 0; i < 100; i++ {
+		chip.PerformNextComputation()
+	}
+	var saved bytes.Buffer
+	if err := chip.Snapshot(&saved); err != nil {
+		t.Fatal(err)
+	}
+
+	// the timer's record is fine but the random number generator's state is cut short
+	corrupted := replaceDeviceState(saved.Bytes(), emulator.RandomBase, "00")
+
+	devices := emulator.NewDevices(nil, nil, 1)
+	restored, err := emulator.NewChipWithDevices(0, devices)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := restored.Restore(bytes.NewReader(corrupted)); !errors.Is(err, emulator.ErrDeviceState) {
+		t.Fatalf("restoring a bad device state gave %v, want %v", err, emulator.ErrDeviceState)
+	}
+	if devices.Timer.Reload != 0 || devices.Interrupts.Enabled != 0 || restored.Pc != 0 {
+		t.Errorf("a failed restore changed the chip or its devices")
+	}
+}
+
+func TestSnapshotRandomReplayIsBounded(t *testing.T) {
+	chip := chiptest.Load(t, snapshotProgram, snapshotOptions)
+	var saved bytes.Buffer
+	if err := chip.Snapshot(&saved); err != nil {
+		t.Fatal(err)
+	}
+
+	// a generator claiming to have drawn 2^64-1 bytes would take forever to replay
+	corrupted := replaceDeviceState(saved.Bytes(), emulator.RandomBase, "000000000000002affffffffffffffff")
+	restored, err := emulator.NewChipWithDevices(0, emulator.NewDevices(nil, nil, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := restored.Restore(bytes.NewReader(corrupted)); !errors.Is(err, emulator.ErrDeviceState) {
+		t.Fatalf("restoring a huge random draw count gave %v, want %v", err, emulator.ErrDeviceState)
+	}
+}
+
+func TestRandomStateAfterManyDraws(t *testing.T) {
+	random := emulator.NewRandom(42)
+	for i := 0; i < 3_000_000; i++ {
+		random.Read(0)
+	}
+	restored := emulator.NewRandom(1)
+	restore, err := restored.DecodeState(random.SaveState())
+	if err != nil {
+		t.Fatal(err)
+	}
+	restore()
+	for i := 0; i < 10; i++ {
+		want, _ := random.Read(0)
+		if got, _ := restored.Read(0); got != want {
+			t.Fatalf("byte %d after restoring is %d, want %d", i, got, want)
+		}
+	}
+}
+
+// replaceDeviceState replaces the state of the device at base in a snapshot and recomputes the checksum, so
+// the snapshot is only caught out by the device rejecting its state
+func replaceDeviceState(snapshot []uint8, base uint16, state string) []uint8 {
+	body := snapshot[:bytes.LastIndex(snapshot, []byte("CHECKSUM"))]
+	record := regexp.MustCompile(fmt.Sprintf(`(?m)^DEVICE %d (\d+) [0-9a-f]+$`, base))
+	body = record.ReplaceAll(append([]uint8{}, body...), []byte(fmt.Sprintf("DEVICE %d $1 %s", base, state)))
+	return append(body, fmt.Sprintf("CHECKSUM %08x\n", crc32.ChecksumIEEE(body))...)
+}
@@ -0,0 +1,68 @@
+package emulator
+
+import (
+	"cheepcheep/isa"
+	"errors"
+)
+
+/**
+The stack:
+	- The stack occupies the region [StackLimit, StackTop) at the top of RAM and grows downwards
+	- $sp points at the most recently pushed value, both $sp and $bp start at StackTop (an empty stack)
+	- Every value on the stack is 16 bits wide and stored big endian like instructions
+	- Pushing below StackLimit is a stack overflow, popping above StackTop is a stack underflow, both
+	  are faults that halt the chip
+
+Frames are set up with ENTER n which pushes $bp, points $bp at the saved value and then reserves n bytes
+below it for locals, LEAVE undoes this. CALL pushes the address of the following instruction and RET pops it.
+*/
+
+const (
+	// StackTop is one past the highest address of the stack
+	StackTop uint16 = 0xF000
+	// StackLimit is the lowest address the stack may grow down to, the stack is 4k
+	StackLimit uint16 = 0xE000
+)
+
+// stack faults
+var (
+	ErrStackOverflow  = errors.New("stack overflow")
+	ErrStackUnderflow = errors.New("stack underflow")
+)
+
+// push pushes a 16 bit value onto the stack
+func (c *Chipster) push(value uint16) error {
+	sp := c.ReadRegister(isa.SP)
+	if sp < StackLimit+2 || sp > StackTop {
+		return ErrStackOverflow
+	}
+
+	sp -= 2
+	if err := c.write(sp, uint8(value>>8)); err != nil {
+		return err
+	}
+	if err := c.write(sp+1, uint8(value)); err != nil {
+		return err
+	}
+	c.writeRegister(isa.SP, sp)
+	return nil
+}
+
+// pop pops a 16 bit value off the stack
+func (c *Chipster) pop() (uint16, error) {
+	sp := c.ReadRegister(isa.SP)
+	if sp < StackLimit || sp > StackTop-2 {
+		return 0, ErrStackUnderflow
+	}
+
+	high, err := c.Bus.Read(sp)
+	if err != nil {
+		return 0, err
+	}
+	low, err := c.Bus.Read(sp + 1)
+	if err != nil {
+		return 0, err
+	}
+	c.writeRegister(isa.SP, sp+2)
+	return uint16(high)<<8 | uint16(low), nil
+}
@@ -0,0 +1,110 @@
+package emulator
+
+import (
+	"cheepcheep/isa"
+	"context"
+	"time"
+)
+
+/**
+Timing:
+	- Every instruction takes a fixed number of clock cycles that depends on its opcode and addressing mode (see
+	  CycleCosts), Chipster.Cycles counts the cycles taken since the chip was started
+	- The costs follow from the work an instruction does: a register or immediate operand is free, computing a
+	  register or PC relative address costs a cycle and every byte read from or written to memory costs a cycle,
+	  on top of that most instructions take a cycle or two to execute while MUL and DIV take longer
+	- Entering an interrupt handler takes InterruptCycles, an instruction that faults before it is decoded takes none
+	- Devices that keep time are ticked once per cycle (see devices.go), so a timer's count is in cycles
+	- Setting ClockSpeed makes Run execute at that many cycles per second, otherwise it runs as fast as it can
+*/
+
+// CycleCosts is the number of cycles each instruction takes, indexed by its addressing mode
+// (immediate, register, register relative and PC relative)
+var CycleCosts = map[isa.Opcode][4]uint64{
+	isa.HLT: {1, 1, 1, 1},
+
+	// relative operands are read from memory, a byte or a word for LDW
+	isa.MOV: {2, 2, 4, 4},
+	isa.LDR: {2, 2, 4, 4},
+	isa.LDW: {2, 2, 5, 5},
+
+	// stores use the computed address and write a byte or a word
+	isa.STR: {2, 2, 3, 3},
+	isa.STW: {3, 3, 4, 4},
+
+	isa.PRINT: {2, 2, 2, 2},
+
+	isa.ADD: {2, 2, 4, 4},
+	isa.SUB: {2, 2, 4, 4},
+	isa.MUL: {4, 4, 6, 6},
+	isa.DIV: {8, 8, 10, 10},
+	isa.XOR: {2, 2, 4, 4},
+	isa.AND: {2, 2, 4, 4},
+	isa.OR:  {2, 2, 4, 4},
+	isa.NOT: {2, 2, 4, 4},
+	isa.CMP: {2, 2, 4, 4},
+
+	// jumps cost the same whether or not they are taken
+	isa.JMP:   {2, 2, 3, 3},
+	isa.JMPL:  {2, 2, 3, 3},
+	isa.JMPG:  {2, 2, 3, 3},
+	isa.JMPLE: {2, 2, 3, 3},
+	isa.JMPGE: {2, 2, 3, 3},
+	isa.JEQ:   {2, 2, 3, 3},
+	isa.JNE:   {2, 2, 3, 3},
+	isa.JB:    {2, 2, 3, 3},
+	isa.JAE:   {2, 2, 3, 3},
+	isa.JBE:   {2, 2, 3, 3},
+	isa.JA:    {2, 2, 3, 3},
+
+	// every value on the stack is a word
+	isa.PUSH:  {4, 4, 6, 6},
+	isa.POP:   {4, 4, 4, 4},
+	isa.CALL:  {4, 4, 5, 5},
+	isa.RET:   {4, 4, 4, 4},
+	isa.ENTER: {5, 5, 7, 7},
+	isa.LEAVE: {4, 4, 4, 4},
+
+	isa.EI:   {1, 1, 1, 1},
+	isa.DI:   {1, 1, 1, 1},
+	isa.IRET: {6, 6, 6, 6},
+}
+
+// InterruptCycles is the number of cycles taken to enter an interrupt handler, pushing Pc and Vf
+// and reading the handler's vector
+const InterruptCycles = 7
+
+// CycleCost returns the number of cycles an instruction takes
+func CycleCost(instruction isa.Instruction) uint64 {
+	return CycleCosts[instruction.Opcode][instruction.Mode&0x3]
+}
+
+// tick advances the devices that keep time by the cycles taken since a step started
+func (c *Chipster) tick(startCycles uint64) {
+	ticker, ok := c.Bus.(Ticker)
+	if !ok {
+		return
+	}
+	for cycle := startCycles; cycle < c.Cycles; cycle++ {
+		ticker.Tick()
+	}
+}
+
+// throttle waits until the wall clock catches up with the cycles executed since start at ClockSpeed
+// cycles per second, the chip only sleeps once it is at least a millisecond ahead so fast clocks don't
+// sleep after every instruction
+func (c *Chipster) throttle(ctx context.Context, start time.Time, cycles uint64) {
+	due := start.Add(time.Duration(cycles/c.ClockSpeed)*time.Second +
+		time.Duration(cycles%c.ClockSpeed)*time.Second/time.Duration(c.ClockSpeed))
+	ahead := time.Until(due)
+	if ahead < time.Millisecond {
+		return
+	}
+
+	timer := time.NewTimer(ahead)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+}
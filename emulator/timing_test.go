@@ -0,0 +1,83 @@
+package emulator_test
+
+import (
+	"cheepcheep/chiptest"
+	"cheepcheep/emulator"
+	"cheepcheep/isa"
+	"context"
+	"testing"
+	"time"
+)
+
+func TestEveryOpcodeHasACycleCost(t *testing.T) {
+	for opcode, info := range isa.OPCODES {
+		costs, ok := emulator.CycleCosts[opcode]
+		if !ok {
+			t.Errorf("%s has no cycle costs", info.Mnemonic)
+			continue
+		}
+		for mode, cost := range costs {
+			if cost == 0 {
+				t.Errorf("%s takes no cycles in addressing mode %d", info.Mnemonic, mode)
+			}
+		}
+	}
+}
+
+func TestCycleCounting(t *testing.T) {
+	result := chiptest.Run(t, `
+	mov $r1, #2
+	ldw $r2, [.value]
+	add $r1, $r2
+	stw $r1, [.value]
+	hlt
+.value
+	.word 3
+`)
+	// mov #2 (2), ldw from memory (5), add a register (2), stw to memory (4), hlt (1)
+	if result.Chip.Cycles != 14 {
+		t.Errorf("program took %d cycles, want 14", result.Chip.Cycles)
+	}
+}
+
+func TestTimerCountsCycles(t *testing.T) {
+	result := chiptest.Run(t, `
+.equ TIMER, 0xF010
+	mov $r1, #20
+	str $r1, [TIMER+1]
+	mov $r1, #1
+	str $r1, [TIMER+2]
+.wait
+	ldr $r2, [TIMER+3]
+	cmp $r2, #0
+	jeq .wait
+	hlt
+`)
+	// the timer counts the 3 cycles of the str that starts it and then 8 cycles for each pass of the
+	// wait loop, so it expires during the third pass and the fourth pass sees it
+	if result.Steps != 4+4*3+1 {
+		t.Errorf("executed %d instructions, want %d", result.Steps, 4+4*3+1)
+	}
+}
+
+func TestClockSpeed(t *testing.T) {
+	chip := chiptest.Load(t, `
+.loop
+	jmp .loop
+`, chiptest.Options{})
+
+	// 50 jumps take 100 cycles which is 50ms at 2kHz, the chip only sleeps once it is at least
+	// a millisecond ahead so the run may finish up to a millisecond early
+	chip.ClockSpeed = 2000
+	minimum := 50*time.Millisecond - time.Millisecond
+	start := time.Now()
+	if _, err := chip.Run(context.Background(), 50); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < minimum {
+		t.Errorf("100 cycles at 2kHz took %s, want at least %s", elapsed, minimum)
+	}
+	if chip.Cycles != 100 {
+		t.Errorf("took %d cycles, want 100", chip.Cycles)
+	}
+}
@@ -0,0 +1,177 @@
+package emulator
+
+import (
+	"bufio"
+	"cheepcheep/isa"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+)
+
+/**
+Tracing:
+	- Tracing is opt in, when the chip has a Tracer every call to PerformNextComputation is recorded as a TraceStep
+	- A step records where it executed, the decoded instruction, its operand, every register and memory write it made
+	  and the flags, program counter and interrupt state it left behind, so applying the steps of a trace in order to
+	  the chip the program was loaded into reconstructs the machine state after any step (see Apply)
+	- Entering an interrupt handler is a step of its own with Interrupt set to the line being serviced
+	- Traces are stored as JSON lines, one step per line (see TraceWriter and ReadTrace)
+*/
+
+// Tracer receives every step the chip takes
+type Tracer interface {
+	Step(step TraceStep) error
+}
+
+// TraceStep is everything a single step of the chip did
+type TraceStep struct {
+	Step uint64 `json:"step"`
+	Pc   uint16 `json:"pc"`
+
+	// Instruction is the executed instruction in chippy syntax and Operand the value of its flexible
+	// operand (the effective address for jumps and stores), both are empty if no instruction executed
+	Instruction string `json:"instruction,omitempty"`
+	Operand     uint16 `json:"operand,omitempty"`
+
+	// Interrupt is the line serviced by the step if it entered an interrupt handler
+	Interrupt *int `json:"interrupt,omitempty"`
+
+	Registers []RegisterWrite `json:"registers,omitempty"`
+	Memory    []MemoryWrite   `json:"memory,omitempty"`
+
+	// the state of the chip after the step
+	Cycles            uint64 `json:"cycles"`
+	Vf                uint16 `json:"vf"`
+	NextPc            uint16 `json:"next"`
+	InterruptsEnabled bool   `json:"ie,omitempty"`
+	Halted            bool   `json:"halted,omitempty"`
+	Fault             string `json:"fault,omitempty"`
+}
+
+// RegisterWrite records a value written to a register
+type RegisterWrite struct {
+	Register uint8  `json:"r"`
+	Value    uint16 `json:"v"`
+}
+
+// MemoryWrite records a byte written to the bus
+type MemoryWrite struct {
+	Address uint16 `json:"a"`
+	Value   uint8  `json:"v"`
+}
+
+// beginTrace starts recording a step if the chip is being traced
+func (c *Chipster) beginTrace() {
+	if c.Tracer != nil {
+		c.trace = &TraceStep{Step: c.steps, Pc: c.Pc}
+	}
+}
+
+// endTrace completes the step being recorded and hands it to the tracer, a tracer that
+// fails is detached so a broken trace file doesn't stop the chip
+func (c *Chipster) endTrace() {
+	c.steps++
+	if c.trace == nil {
+		return
+	}
+
+	step := c.trace
+	c.trace = nil
+	step.Cycles, step.Vf, step.NextPc = c.Cycles, c.Vf, c.Pc
+	step.InterruptsEnabled, step.Halted = c.InterruptsEnabled, c.Halted
+	if c.Fault != nil {
+		step.Fault = c.Fault.Error()
+	}
+	if err := c.Tracer.Step(*step); err != nil {
+		c.Tracer = nil
+	}
+}
+
+// write writes a byte to the bus, recording it if the step is being traced and remembering the
+// byte it overwrote if the step can be undone (see history.go)
+func (c *Chipster) write(address uint16, value uint8) error {
+	var previous uint8
+	restorable := false
+	if c.undo != nil {
+		previous, restorable = c.Peek(address)
+	}
+
+	if err := c.Bus.Write(address, value); err != nil {
+		return err
+	}
+	if c.trace != nil {
+		c.trace.Memory = append(c.trace.Memory, MemoryWrite{address, value})
+	}
+	if restorable {
+		c.undo.memory = append(c.undo.memory, MemoryWrite{address, previous})
+	}
+	return nil
+}
+
+// Apply replays a step onto a chip, leaving it in the state the traced chip was in after the step,
+// memory writes are loaded directly into RAM and ROM while writes to devices are skipped, the chip
+// should have the same memory map as the traced chip so a write to an unmapped address is an error
+func (s TraceStep) Apply(c *Chipster) error {
+	for _, write := range s.Registers {
+		if write.Register >= isa.NumRegisters {
+			return fmt.Errorf("step %d: there is no register %d", s.Step, write.Register)
+		}
+		c.writeRegister(write.Register, write.Value)
+	}
+
+	loader, canLoad := c.Bus.(interface{ Load(uint16, []uint8) error })
+	for _, write := range s.Memory {
+		if !canLoad {
+			if err := c.Bus.Write(write.Address, write.Value); err != nil {
+				return fmt.Errorf("step %d: %w", s.Step, err)
+			}
+		} else if err := loader.Load(write.Address, []uint8{write.Value}); err != nil {
+			// devices can't be loaded and are skipped, writing to them again would repeat their side effects
+			if errors.Is(err, ErrUnmappedAddress) {
+				return fmt.Errorf("step %d: %w", s.Step, err)
+			}
+		}
+	}
+
+	c.Cycles, c.Vf, c.Pc = s.Cycles, s.Vf, s.NextPc
+	c.InterruptsEnabled, c.Halted = s.InterruptsEnabled, s.Halted
+	c.steps = s.Step + 1
+	return nil
+}
+
+// TraceWriter is a Tracer that writes each step as a line of JSON
+type TraceWriter struct {
+	output  *bufio.Writer
+	encoder *json.Encoder
+}
+
+// NewTraceWriter builds a tracer that writes to w, Flush must be called once tracing is done
+func NewTraceWriter(w io.Writer) *TraceWriter {
+	output := bufio.NewWriter(w)
+	return &TraceWriter{output: output, encoder: json.NewEncoder(output)}
+}
+
+func (t *TraceWriter) Step(step TraceStep) error {
+	return t.encoder.Encode(step)
+}
+
+// Flush writes out any buffered steps
+func (t *TraceWriter) Flush() error {
+	return t.output.Flush()
+}
+
+// ReadTrace reads a trace written by a TraceWriter
+func ReadTrace(r io.Reader) ([]TraceStep, error) {
+	steps := []TraceStep{}
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 1<<20)
+	for line := 1; scanner.Scan(); line++ {
+		var step TraceStep
+		if err := json.Unmarshal(scanner.Bytes(), &step); err != nil {
+			return nil, fmt.Errorf("trace line %d: %w", line, err)
+		}
+		steps = append(steps, step)
+	}
+	return steps, scanner.Err()
+}
@@ -0,0 +1,70 @@
+package emulator_test
+
+import (
+	"bytes"
+	"cheepcheep/chiptest"
+	"cheepcheep/emulator"
+	"testing"
+)
+
+func TestTraceReplay(t *testing.T) {
+	const program = `
+	mov $r1, #3
+.loop
+	push $r1
+	sub $r1, #1
+	jne .loop
+	stw $r1, [.data]
+	call .sub
+	hlt
+.sub
+	mov $r2, #7
+	ret
+.data
+	.word 0xFFFF
+`
+
+	var recorded bytes.Buffer
+	tracer := emulator.NewTraceWriter(&recorded)
+	chip := chiptest.Load(t, program, chiptest.Options{})
+	chip.Tracer = tracer
+	for !chip.Halted {
+		chip.PerformNextComputation()
+	}
+	if err := tracer.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	steps, err := emulator.ReadTrace(&recorded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(steps) != 15 || steps[0].Instruction != "mov $r1, #3" {
+		t.Fatalf("got %d steps starting with %q, want 15 starting with mov", len(steps), steps[0].Instruction)
+	}
+
+	replayed := chiptest.Load(t, program, chiptest.Options{})
+	for _, step := range steps {
+		if err := step.Apply(replayed); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if replayed.Registers != chip.Registers || replayed.StackRegisters != chip.StackRegisters ||
+		replayed.Pc != chip.Pc || replayed.Vf != chip.Vf || !replayed.Halted {
+		t.Errorf("replayed state differs from the traced chip")
+	}
+	for address := uint16(0); address < 0x100; address++ {
+		want, _ := chip.Bus.Read(address)
+		got, _ := replayed.Bus.Read(address)
+		if got != want {
+			t.Errorf("memory at 0x%04x is %d after replaying, want %d", address, got, want)
+		}
+	}
+	for address := emulator.StackTop - 8; address < emulator.StackTop; address++ {
+		want, _ := chip.Bus.Read(address)
+		got, _ := replayed.Bus.Read(address)
+		if got != want {
+			t.Errorf("stack at 0x%04x is %d after replaying, want %d", address, got, want)
+		}
+	}
+}
@@ -0,0 +1,161 @@
+package isa
+
+import (
+	"fmt"
+	"strings"
+)
+
+// InstructionSize is the size in bytes of every encoded instruction
+const InstructionSize = 4
+
+// AddrMode is the 2 bit addressing mode of an instruction's flexible operand
+type AddrMode uint8
+
+/*
+Addressing modes and how they resolve the flexible operand:
+  - Immediate:        the operand is the 16 bit value itself, when used as an address the value is the address
+  - Register:         the operand is the contents of the register, when used as an address the register holds it
+  - RegisterRelative: the operand lives in memory at register + 16 bit offset
+  - PCRelative:       the operand lives in memory at the address of the instruction + signed 16 bit offset
+*/
+const (
+	Immediate        AddrMode = 0
+	Register         AddrMode = 1
+	RegisterRelative AddrMode = 2
+	PCRelative       AddrMode = 3
+)
+
+// Instruction is a single decoded instruction
+type Instruction struct {
+	Opcode Opcode
+	Mode   AddrMode
+
+	// Reg is the plain register operand, for instructions that take one
+	Reg uint8
+
+	// Base and Value describe the flexible operand, Base is the register used by the register and
+	// register relative modes while Value is the immediate value, offset or address
+	Base  uint8
+	Value uint16
+}
+
+// Encode packs an instruction into its 4 byte representation, the operands are packed as follows:
+//   - register operands take 4 bits
+//   - immediate and PC relative operands take 16 bits
+//   - register relative operands take 20 bits, the register followed by the offset
+//
+// eg: add $r1, #3 encodes to:
+//   - [001000 00][0001][0000 0000 0000 0011][0000]
+func Encode(instruction Instruction) ([InstructionSize]byte, error) {
+	info, ok := OPCODES[instruction.Opcode]
+	if !ok {
+		return [InstructionSize]byte{}, fmt.Errorf("unknown opcode 0x%x", uint8(instruction.Opcode))
+	}
+
+	var word uint32 = uint32(instruction.Opcode)<<26 | uint32(instruction.Mode&0x3)<<24
+	var consumedBits uint32 = 8
+	pack := func(value uint32, bits uint32) {
+		word |= (value & (1<<bits - 1)) << (32 - consumedBits - bits)
+		consumedBits += bits
+	}
+
+	for _, operand := range info.Operands {
+		if operand == RegisterOperand {
+			pack(uint32(instruction.Reg), 4)
+			continue
+		}
+
+		switch instruction.Mode {
+		case Immediate, PCRelative:
+			pack(uint32(instruction.Value), 16)
+		case Register:
+			pack(uint32(instruction.Base), 4)
+		case RegisterRelative:
+			pack(uint32(instruction.Base), 4)
+			pack(uint32(instruction.Value), 16)
+		}
+	}
+
+	return [InstructionSize]byte{byte(word >> 24), byte(word >> 16), byte(word >> 8), byte(word)}, nil
+}
+
+// Decode unpacks a 4 byte instruction, it is the inverse of Encode
+func Decode(encoded [InstructionSize]byte) (Instruction, error) {
+	word := uint32(encoded[0])<<24 | uint32(encoded[1])<<16 | uint32(encoded[2])<<8 | uint32(encoded[3])
+	instruction := Instruction{
+		Opcode: Opcode(encoded[0] >> 2),
+		Mode:   AddrMode(encoded[0] & 0x3),
+	}
+
+	info, ok := OPCODES[instruction.Opcode]
+	if !ok {
+		return instruction, fmt.Errorf("unknown opcode 0x%x", uint8(instruction.Opcode))
+	}
+
+	var consumedBits uint32 = 8
+	unpack := func(bits uint32) uint32 {
+		value := (word >> (32 - consumedBits - bits)) & (1<<bits - 1)
+		consumedBits += bits
+		return value
+	}
+
+	for _, operand := range info.Operands {
+		if operand == RegisterOperand {
+			instruction.Reg = uint8(unpack(4))
+			continue
+		}
+
+		switch instruction.Mode {
+		case Immediate, PCRelative:
+			instruction.Value = uint16(unpack(16))
+		case Register:
+			instruction.Base = uint8(unpack(4))
+		case RegisterRelative:
+			instruction.Base = uint8(unpack(4))
+			instruction.Value = uint16(unpack(16))
+		}
+	}
+
+	return instruction, nil
+}
+
+// String formats the instruction in chippy assembly syntax
+func (i Instruction) String() string {
+	info, ok := OPCODES[i.Opcode]
+	if !ok {
+		return fmt.Sprintf("??? (0x%x)", uint8(i.Opcode))
+	}
+
+	output := strings.ToLower(info.Mnemonic)
+	for n, operand := range info.Operands {
+		if n == 0 {
+			output += " "
+		} else {
+			output += ", "
+		}
+
+		if operand == RegisterOperand {
+			output += "$" + RegisterName(i.Reg)
+		} else {
+			output += i.FormatOperand()
+		}
+	}
+	return output
+}
+
+// FormatOperand formats the flexible operand of the instruction in chippy assembly syntax
+func (i Instruction) FormatOperand() string {
+	switch i.Mode {
+	case Register:
+		return "$" + RegisterName(i.Base)
+	case RegisterRelative:
+		if i.Base == ZERO {
+			return fmt.Sprintf("[%d]", i.Value)
+		}
+		return fmt.Sprintf("%d+$%s", i.Value, RegisterName(i.Base))
+	case PCRelative:
+		return fmt.Sprintf("#(%d)", i.Value)
+	default:
+		return fmt.Sprintf("#%d", i.Value)
+	}
+}
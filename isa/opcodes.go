@@ -0,0 +1,200 @@
+package isa
+
+/*
+	The isa package is the single source of truth for the Chipster instruction set, both the chippy
+	assembler and the emulator consume it so the two can't drift apart.
+
+	Notes on encoded instructions:
+		- Every instruction is exactly 4 bytes (InstructionSize) and is stored big endian
+		- The first byte holds the opcode in its upper 6 bits and the addressing mode in its lower 2 bits
+		- The remaining 24 bits hold the operands packed from the most significant bit downwards
+		- Each instruction has at most one "flexible" operand, its addressing mode is the one stored in the
+		  first byte, every other operand is a plain register
+*/
+
+// Opcode is the 6 bit numeric code of an operation
+type Opcode uint8
+
+// OperandKind describes how an operand is laid out in an encoded instruction
+type OperandKind uint8
+
+const (
+	// RegisterOperand is a plain 4 bit register index
+	RegisterOperand OperandKind = iota
+	// FlexibleOperand is an operand whose encoding is dictated by the instruction's addressing mode
+	FlexibleOperand
+)
+
+// the full set of opcodes
+const (
+	HLT   Opcode = 0x0
+	MOV   Opcode = 0x1
+	LDR   Opcode = 0x2
+	PRINT Opcode = 0x3
+	CMP   Opcode = 0x4
+	JMPL  Opcode = 0x5
+	JMPG  Opcode = 0x6
+	JMP   Opcode = 0x7
+
+	// ALU operations all live in the block 0b001xxx, the lower 3 bits select the operation
+	ADD Opcode = 0x8
+	SUB Opcode = 0x9
+	MUL Opcode = 0xA
+	DIV Opcode = 0xB
+	XOR Opcode = 0xC
+	AND Opcode = 0xD
+	OR  Opcode = 0xE
+	NOT Opcode = 0xF
+
+	JMPLE Opcode = 0x10
+	JMPGE Opcode = 0x11
+	STR   Opcode = 0x12
+
+	// stack operations
+	PUSH  Opcode = 0x13
+	POP   Opcode = 0x14
+	CALL  Opcode = 0x15
+	RET   Opcode = 0x16
+	ENTER Opcode = 0x17
+	LEAVE Opcode = 0x18
+
+	// interrupt control
+	EI   Opcode = 0x19
+	DI   Opcode = 0x1A
+	IRET Opcode = 0x1B
+
+	// equality and unsigned conditional jumps, the signed jumps are JMPL, JMPG, JMPLE and JMPGE
+	JEQ Opcode = 0x1C
+	JNE Opcode = 0x1D
+	JB  Opcode = 0x1E
+	JAE Opcode = 0x1F
+	JBE Opcode = 0x20
+	JA  Opcode = 0x21
+
+	// 16 bit loads and stores
+	LDW Opcode = 0x22
+	STW Opcode = 0x23
+)
+
+// ALU is the block of opcodes that are arithmetic/logic operations
+const ALU Opcode = 0x8
+
+// IsALU determines if an opcode belongs to the ALU block
+func (o Opcode) IsALU() bool {
+	return o&0x38 == ALU
+}
+
+// IsConditionalJump determines if an opcode is a jump that depends on the flags
+func (o Opcode) IsConditionalJump() bool {
+	switch o {
+	case JMPL, JMPG, JMPLE, JMPGE, JEQ, JNE, JB, JAE, JBE, JA:
+		return true
+	}
+	return false
+}
+
+// OpcodeInfo describes a single entry in the opcode table
+type OpcodeInfo struct {
+	Mnemonic string
+	Operands []OperandKind
+
+	// Addressed is set if the flexible operand is used as an address (eg. the target of a jump)
+	// rather than as a value
+	Addressed bool
+}
+
+var registerAndOperand = []OperandKind{RegisterOperand, FlexibleOperand}
+var operandOnly = []OperandKind{FlexibleOperand}
+var registerOnly = []OperandKind{RegisterOperand}
+
+// OPCODES is the opcode table, it maps each opcode to its mnemonic and operand layout
+var OPCODES = map[Opcode]OpcodeInfo{
+	// halt
+	HLT: {"HLT", nil, false},
+
+	// move a value into a register, load a value from memory into a register
+	// and store a register in memory
+	MOV: {"MOV", registerAndOperand, false},
+	LDR: {"LDR", registerAndOperand, false},
+	STR: {"STR", registerAndOperand, true},
+
+	// the same as LDR and STR but move a 16 bit big endian word to and from memory
+	LDW: {"LDW", registerAndOperand, false},
+	STW: {"STW", registerAndOperand, true},
+
+	// print contents of register to standard out
+	PRINT: {"PRINT", registerOnly, false},
+
+	// arithmetic on the value stored in a register
+	ADD: {"ADD", registerAndOperand, false},
+	SUB: {"SUB", registerAndOperand, false},
+	MUL: {"MUL", registerAndOperand, false},
+	DIV: {"DIV", registerAndOperand, false},
+	XOR: {"XOR", registerAndOperand, false},
+	AND: {"AND", registerAndOperand, false},
+	OR:  {"OR", registerAndOperand, false},
+	NOT: {"NOT", registerAndOperand, false},
+
+	// compare the register with the operand and set the flag register
+	CMP: {"CMP", registerAndOperand, false},
+
+	// jump instructions based on conditional flags, JMPL, JMPG, JMPLE and JMPGE compare signed values
+	// while JB, JA, JBE and JAE compare unsigned values
+	JMPL:  {"JMPL", operandOnly, true},
+	JMPG:  {"JMPG", operandOnly, true},
+	JMP:   {"JMP", operandOnly, true},
+	JMPLE: {"JMPLE", operandOnly, true},
+	JMPGE: {"JMPGE", operandOnly, true},
+	JEQ:   {"JEQ", operandOnly, true},
+	JNE:   {"JNE", operandOnly, true},
+	JB:    {"JB", operandOnly, true},
+	JAE:   {"JAE", operandOnly, true},
+	JBE:   {"JBE", operandOnly, true},
+	JA:    {"JA", operandOnly, true},
+
+	// push a value onto the stack and pop the top of the stack into a register
+	PUSH: {"PUSH", operandOnly, false},
+	POP:  {"POP", registerOnly, false},
+
+	// call a subroutine (pushing the return address) and return from it
+	CALL: {"CALL", operandOnly, true},
+	RET:  {"RET", nil, false},
+
+	// set up a stack frame with room for the given number of bytes and tear it down again
+	ENTER: {"ENTER", operandOnly, false},
+	LEAVE: {"LEAVE", nil, false},
+
+	// enable and disable interrupts and return from an interrupt handler
+	EI:   {"EI", nil, false},
+	DI:   {"DI", nil, false},
+	IRET: {"IRET", nil, false},
+}
+
+// ALIASES are alternative mnemonics for opcodes, they're accepted by the assembler but never
+// produced by the disassembler
+var ALIASES = map[string]Opcode{
+	"JLT": JMPL,
+	"JGT": JMPG,
+	"JLE": JMPLE,
+	"JGE": JMPGE,
+}
+
+// MNEMONICS is the reverse of the opcode table, it maps a mnemonic (or alias) to its opcode
+var MNEMONICS = map[string]Opcode{}
+
+func init() {
+	for opcode, info := range OPCODES {
+		MNEMONICS[info.Mnemonic] = opcode
+	}
+	for alias, opcode := range ALIASES {
+		MNEMONICS[alias] = opcode
+	}
+}
+
+// String returns the mnemonic of the opcode
+func (o Opcode) String() string {
+	if info, ok := OPCODES[o]; ok {
+		return info.Mnemonic
+	}
+	return "???"
+}
@@ -0,0 +1,48 @@
+package isa
+
+/*
+	Chipster has 16 addressable registers, each is identified by a 4 bit index:
+		- 0 is the zero register, it always reads as 0 and writes to it are discarded
+		- 1 through 13 are the general purpose registers
+		- 14 is the stack pointer and 15 is the stack base pointer
+	The status flags are not addressable, they live in the separate flag register.
+*/
+
+const (
+	ZERO uint8 = 0
+	SP   uint8 = 14
+	BP   uint8 = 15
+
+	// NumRegisters is the number of addressable registers
+	NumRegisters = 16
+)
+
+// REGISTERS maps register names (as written in assembly, without the $) to their index
+var REGISTERS = map[string]uint8{
+	"zero": ZERO,
+	"r1":   1,
+	"r2":   2,
+	"r3":   3,
+	"r4":   4,
+	"r5":   5,
+	"r6":   6,
+	"r7":   7,
+	"r8":   8,
+	"r9":   9,
+	"r10":  10,
+	"r11":  11,
+	"r12":  12,
+	"r13":  13,
+	"sp":   SP,
+	"bp":   BP,
+}
+
+// RegisterName returns the assembly name of a register index
+func RegisterName(register uint8) string {
+	for name, index := range REGISTERS {
+		if index == register {
+			return name
+		}
+	}
+	return "???"
+}
@@ -3,6 +3,9 @@ package main
 import (
 	"bufio"
 	"cheepcheep/chippy"
+	"errors"
+	"flag"
+	"fmt"
 	"os"
 )
 
@@ -10,16 +13,48 @@ import (
 // see the chippy directory for more information
 
 func main() {
-	sourceFile := os.Args[1]
-	outputFile := os.Args[2]
+	debugFile := flag.String("debug", "", "also write a symbol and source map file to this path")
+	objectOutput := flag.Bool("c", false, "write a relocatable object to be combined by the linker instead of a ROM")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: %s [flags] source.chippy output.chip\n", os.Args[0])
+		fmt.Fprintf(flag.CommandLine.Output(), "       %s -c source.chippy output.obj\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() != 2 || (*objectOutput && *debugFile != "") {
+		flag.Usage()
+		os.Exit(2)
+	}
+	sourceFile := flag.Arg(0)
+	outputFile := flag.Arg(1)
 
-	f, _ := os.Open(sourceFile)
-	o, _ := os.Create(outputFile)
+	f, err := os.Open(sourceFile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error - could not open source file: %s\n", err)
+		os.Exit(1)
+	}
 	defer f.Close()
-	defer o.Close()
 
-	nodes := chippy.Parse(*bufio.NewReader(f))
-	compiledStream := chippy.Compile(nodes)
+	// even if parsing fails we still compile whatever was parsed
+	// so that a single run reports as many problems as possible
+	nodes, parseErr := chippy.Parse(sourceFile, *bufio.NewReader(f))
+	if *objectOutput {
+		writeObject(nodes, parseErr, outputFile)
+		return
+	}
+
+	compiledStream, compileErr := chippy.Compile(nodes)
+	if parseErr != nil || compileErr != nil {
+		reportErrors(parseErr, compileErr)
+	}
+
+	o, err := os.Create(outputFile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error - could not create output file: %s\n", err)
+		os.Exit(1)
+	}
+	defer o.Close()
 
 	// write the compiled stream out
 	w := bufio.NewWriter(o)
@@ -27,4 +62,64 @@ func main() {
 		w.WriteByte(c)
 	}
 	w.Flush()
+
+	if *debugFile != "" {
+		writeDebugInfo(nodes, *debugFile)
+	}
+}
+
+// writeObject writes the program out as a relocatable object rather than assembling it
+func writeObject(nodes []chippy.SyntaxNode, parseErr error, outputFile string) {
+	object, err := chippy.NewObject(nodes)
+	if parseErr != nil || err != nil {
+		reportErrors(parseErr, err)
+	}
+
+	o, err := os.Create(outputFile)
+	if err == nil {
+		err = object.Write(o)
+		o.Close()
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error - could not write object file: %s\n", err)
+		os.Exit(1)
+	}
+}
+
+// writeDebugInfo writes the symbol table and source map of the program out to a file
+func writeDebugInfo(nodes []chippy.SyntaxNode, debugFile string) {
+	table, err := chippy.DebugInfo(nodes)
+	if err != nil {
+		reportErrors(err)
+	}
+
+	d, err := os.Create(debugFile)
+	if err == nil {
+		err = table.Write(d)
+		d.Close()
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error - could not write debug file: %s\n", err)
+		os.Exit(1)
+	}
+}
+
+// reportErrors prints every diagnostic along with an excerpt of the offending source
+// and then exits
+func reportErrors(errs ...error) {
+	var diagnostics chippy.Diagnostics
+	for _, err := range errs {
+		var collected chippy.Diagnostics
+		if err == nil {
+			continue
+		} else if !errors.As(err, &collected) {
+			fmt.Fprintf(os.Stderr, "Error - %s\n", err)
+			os.Exit(1)
+		}
+		diagnostics = append(diagnostics, collected...)
+	}
+
+	diagnostics.Report(os.Stderr)
+	fmt.Fprintf(os.Stderr, "%d error(s), assembly failed\n", len(diagnostics))
+	os.Exit(1)
 }
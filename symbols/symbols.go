@@ -0,0 +1,195 @@
+package symbols
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+/*
+	The symbols package describes the debug information the assembler can emit alongside a ROM, it maps
+	labels to addresses and addresses back to the source lines they were assembled from.
+
+	The sidecar file is a line oriented text file, the first line is a header and every other line is a record
+	whose fields are separated by spaces:
+		CHIPPYDBG 1
+		LABEL <name> <address>
+		LINE <address> <line> <column> <quoted file name>
+	Addresses are written in hex (0x prefixed), lines and columns are 1 indexed and the file name is
+	a Go style quoted string. Blank lines and lines starting with # are ignored.
+*/
+
+const header = "CHIPPYDBG"
+const version = 1
+
+// LineEntry maps the instruction at an address back to its position in the source
+type LineEntry struct {
+	Address uint16
+	File    string
+	Line    int
+	Column  int
+}
+
+// Table holds all the debug information for a single ROM
+type Table struct {
+	Labels map[string]uint16
+
+	// Lines is sorted by address
+	Lines []LineEntry
+}
+
+// NewTable builds an empty symbol table
+func NewTable() *Table {
+	return &Table{Labels: map[string]uint16{}}
+}
+
+// AddLine records the source position of the instruction at an address
+func (t *Table) AddLine(entry LineEntry) {
+	index := sort.Search(len(t.Lines), func(i int) bool { return t.Lines[i].Address >= entry.Address })
+	t.Lines = append(t.Lines, LineEntry{})
+	copy(t.Lines[index+1:], t.Lines[index:])
+	t.Lines[index] = entry
+}
+
+// LabelFor finds the closest label at or before an address, it returns the label
+// and the offset of the address from it
+func (t *Table) LabelFor(address uint16) (string, uint16, bool) {
+	closest, closestAddress, found := "", uint16(0), false
+	for label, labelAddress := range t.Labels {
+		if labelAddress <= address && (!found || labelAddress > closestAddress || (labelAddress == closestAddress && label < closest)) {
+			closest, closestAddress, found = label, labelAddress, true
+		}
+	}
+	return closest, address - closestAddress, found
+}
+
+// LineFor finds the source position of the instruction containing an address
+func (t *Table) LineFor(address uint16) (LineEntry, bool) {
+	index := sort.Search(len(t.Lines), func(i int) bool { return t.Lines[i].Address > address })
+	if index == 0 {
+		return LineEntry{}, false
+	}
+	return t.Lines[index-1], true
+}
+
+// Describe formats an address symbolically, eg: .loopBody+4 (print_ten.chippy:4), if nothing is
+// known about the address it is just formatted in hex
+func (t *Table) Describe(address uint16) string {
+	description := fmt.Sprintf("0x%04x", address)
+	if t == nil {
+		return description
+	}
+
+	if label, offset, ok := t.LabelFor(address); ok && offset == 0 {
+		description = label
+	} else if ok {
+		description = fmt.Sprintf("%s+%d", label, offset)
+	}
+	if line, ok := t.LineFor(address); ok {
+		description += fmt.Sprintf(" (%s:%d)", filepath.Base(line.File), line.Line)
+	}
+	return description
+}
+
+// Write serializes the table in the format described at the top of this file
+func (t *Table) Write(w io.Writer) error {
+	output := bufio.NewWriter(w)
+	fmt.Fprintf(output, "%s %d\n", header, version)
+
+	labels := make([]string, 0, len(t.Labels))
+	for label := range t.Labels {
+		labels = append(labels, label)
+	}
+	sort.Slice(labels, func(i, j int) bool {
+		if t.Labels[labels[i]] != t.Labels[labels[j]] {
+			return t.Labels[labels[i]] < t.Labels[labels[j]]
+		}
+		return labels[i] < labels[j]
+	})
+	for _, label := range labels {
+		fmt.Fprintf(output, "LABEL %s 0x%04x\n", label, t.Labels[label])
+	}
+
+	for _, line := range t.Lines {
+		fmt.Fprintf(output, "LINE 0x%04x %d %d %s\n", line.Address, line.Line, line.Column, strconv.Quote(line.File))
+	}
+	return output.Flush()
+}
+
+// Read parses a table written by Write
+func Read(r io.Reader) (*Table, error) {
+	table := NewTable()
+	scanner := bufio.NewScanner(r)
+
+	lineNumber := 0
+	sawHeader := false
+	for scanner.Scan() {
+		lineNumber++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.SplitN(line, " ", 5)
+		if !sawHeader {
+			if len(fields) != 2 || fields[0] != header || fields[1] != strconv.Itoa(version) {
+				return nil, fmt.Errorf("line %d: not a version %d chippy debug file", lineNumber, version)
+			}
+			sawHeader = true
+			continue
+		}
+
+		var err error
+		switch {
+		case fields[0] == "LABEL" && len(fields) == 3:
+			var address uint64
+			address, err = strconv.ParseUint(fields[2], 0, 16)
+			table.Labels[fields[1]] = uint16(address)
+		case fields[0] == "LINE" && len(fields) == 5:
+			entry := LineEntry{}
+			var address uint64
+			if address, err = strconv.ParseUint(fields[1], 0, 16); err != nil {
+				break
+			}
+			entry.Address = uint16(address)
+			if entry.Line, err = strconv.Atoi(fields[2]); err != nil {
+				break
+			}
+			if entry.Column, err = strconv.Atoi(fields[3]); err != nil {
+				break
+			}
+			if entry.File, err = strconv.Unquote(fields[4]); err != nil {
+				break
+			}
+			table.AddLine(entry)
+		default:
+			err = fmt.Errorf("unrecognised record %q", line)
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", lineNumber, err)
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	} else if !sawHeader {
+		return nil, fmt.Errorf("empty debug file")
+	}
+	return table, nil
+}
+
+// Load reads a table from a file on disk
+func Load(path string) (*Table, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return Read(file)
+}